@@ -4,12 +4,17 @@ import (
 	"encoding/gob"
 	"errors"
 	"fmt"
+	"time"
 
 	"github.com/golang/glog"
 )
 
 const (
 	detachedRcvrId = 0
+
+	// stagePollInterval is how often pollLiveStages heartbeats this stage
+	// and refreshes liveStages from the registry.
+	stagePollInterval = 5 * time.Second
 )
 
 type mapper struct {
@@ -18,6 +23,35 @@ type mapper struct {
 	lastRId    uint32
 	idToRcvrs  map[RcvrId]receiver
 	keyToRcvrs map[DictionaryKey]receiver
+
+	// legacyPlacement makes lock fall back to the old first-writer
+	// behavior (racing registery.StoreOrGet) instead of rendezvous
+	// hashing, for backward compat during a rollout.
+	legacyPlacement bool
+	// placement overrides the default rendezvous hash; nil means use
+	// rendezvousScore, or the actor's own Placer implementation if it has
+	// one. See placementFunc.
+	placement PlacementFunc
+	// liveStages is the candidate set for rendezvous hashing. pollLiveStages
+	// keeps it in sync with the registry's heartbeated stage set, so the
+	// ring reflects stages as they join or leave. Empty until the first
+	// poll completes, during which lockRendezvous falls back to
+	// lockLegacy.
+	liveStages []StageId
+
+	// legacyMigrateProto makes dialNewRcvr speak the old untyped gob
+	// handshake instead of the msgpack-framed, capability-negotiated
+	// protocol in migrate_protocol.go, for interop during a rollout.
+	legacyMigrateProto bool
+}
+
+// Snapshotter is implemented by a State that can serialize the entries
+// owned by a MapSet for transfer during migration. A State that doesn't
+// implement it is migrated empty, same as before mapper learned to carry
+// state across a migration.
+type Snapshotter interface {
+	Snapshot(ms MapSet) ([]byte, error)
+	Restore(ms MapSet, snapshot []byte) error
 }
 
 func (mapr *mapper) state() State {
@@ -58,6 +92,10 @@ func (mapr *mapper) start() {
 		go d.start()
 	}
 
+	if !mapr.ctx.stage.isIsol() && !mapr.legacyPlacement {
+		go mapr.pollLiveStages()
+	}
+
 	for {
 		select {
 		case d, ok := <-mapr.dataCh:
@@ -121,9 +159,28 @@ func (mapr *mapper) handleCmd(cmd routineCmd) {
 	case migrateRcvrCmd:
 		m := cmd.cmdData.(migrateRcvrCmdData)
 		mapr.migrate(m.From, m.To, cmd.resCh)
+
+	case refreshStagesCmd:
+		stages := cmd.cmdData.([]StageId)
+		mapr.rehomeDeparted(stages)
+
+	case restoreStateCmd:
+		req := cmd.cmdData.(transferStateReq)
+		mapr.restoreState(req, cmd.resCh)
 	}
 }
 
+// refreshStagesCmd and restoreStateCmd extend the control-command enum
+// (stopCmd/findRcvrCmd/newRcvrCmd/migrateRcvrCmd) with two more verbs.
+// pollLiveStages below and the migrate connection goroutine
+// (migrate_protocol.go) must not touch liveStages/idToRcvrs/ctx.state
+// themselves, since handleCmd's select loop is the only synchronization
+// this package has for that state; both dispatch through ctrlCh instead, so
+// rehomeDeparted and restoreState run serialized with everything else
+// handleCmd does.
+const refreshStagesCmd cmdType = migrateRcvrCmd + 1
+const restoreStateCmd cmdType = migrateRcvrCmd + 2
+
 func (mapr *mapper) registerDetached(h DetachedHandler) error {
 	return mapr.setDetached(mapr.newDetachedRcvr(h))
 }
@@ -219,11 +276,24 @@ func (mapr *mapper) lock(mapSet MapSet, force bool) RcvrId {
 		return id
 	}
 
+	if force || mapr.legacyPlacement {
+		return mapr.lockLegacy(id, mapSet, force)
+	}
+
+	return mapr.lockRendezvous(id, mapSet)
+}
+
+// lockLegacy is the original first-writer placement: it races
+// registery.StoreOrGet and accepts whichever stage's write landed first.
+// It remains available via legacyPlacement for deployments that rely on
+// that behavior, and is always used when force is set since force means
+// the caller has already decided the owner.
+func (mapr *mapper) lockLegacy(id RcvrId, mapSet MapSet, force bool) RcvrId {
 	var v regVal
 	if force {
-		v = mapr.ctx.stage.registery.set(id, mapSet)
+		v = mapr.ctx.stage.registery.Set(id, mapSet)
 	} else {
-		v = mapr.ctx.stage.registery.storeOrGet(id, mapSet)
+		v = mapr.ctx.stage.registery.StoreOrGet(id, mapSet)
 	}
 
 	if v.StageId == id.StageId && v.RcvrId == id.Id {
@@ -236,13 +306,139 @@ func (mapr *mapper) lock(mapSet MapSet, force bool) RcvrId {
 	return id
 }
 
+// lockRendezvous picks the owner of mapSet deterministically via HRW
+// hashing over liveStages, instead of racing the registry: every stage
+// computes the same winner from the same inputs, so placement is settled
+// without a round trip unless the winner is remote. When this stage loses,
+// it dials the winner to create (or find) the receiver there and proxies to
+// it, same as mapr.migrate does when rehoming a MapSet explicitly.
+func (mapr *mapper) lockRendezvous(id RcvrId, mapSet MapSet) RcvrId {
+	if len(mapr.liveStages) == 0 {
+		// We don't yet know the live stage set (pollLiveStages hasn't
+		// completed its first refresh, or the registry has no other
+		// stages heartbeating), so HRW can't be trusted to agree with
+		// other stages: fall back to the registry-arbitrated first-writer
+		// path instead of unconditionally claiming mapSet for ourselves,
+		// which would race every other stage in the same situation.
+		return mapr.lockLegacy(id, mapSet, false)
+	}
+
+	winner := pickStage(mapr.placementFunc(), id.ActorName, mapSet, mapr.liveStages)
+	if winner == id.StageId {
+		mapr.ctx.stage.registery.Set(id, mapSet)
+		return id
+	}
+
+	remoteId, err := mapr.dialNewRcvr(winner, id.ActorName, nil)
+	if err != nil {
+		glog.Errorf("Cannot reach rendezvous winner %v for %v, keeping locally: %v",
+			winner, id.ActorName, err)
+		mapr.ctx.stage.registery.Set(id, mapSet)
+		return id
+	}
+
+	mapr.lastRId--
+	mapr.ctx.stage.registery.Set(remoteId, mapSet)
+	return remoteId
+}
+
+// placementFunc returns the PlacementFunc mapr.lockRendezvous should use:
+// the actor's own override if it implements Placer, mapr.placement if one
+// was explicitly set, or rendezvousScore by default.
+func (mapr *mapper) placementFunc() PlacementFunc {
+	if p, ok := mapr.ctx.actor.(Placer); ok {
+		return p.PlaceMapSet
+	}
+
+	if mapr.placement != nil {
+		return mapr.placement
+	}
+
+	return rendezvousScore
+}
+
+// setLiveStages updates the candidate set used for rendezvous hashing. It
+// is called from rehomeDeparted, on the mapper's own goroutine.
+func (mapr *mapper) setLiveStages(stages []StageId) {
+	mapr.liveStages = stages
+}
+
+// pollLiveStages keeps liveStages in sync with the registry: it heartbeats
+// this stage so other stages' Stages() calls see it, then hands its
+// refreshed view to the mapper's own goroutine via refreshStagesCmd, which
+// re-homes whatever the refresh invalidates. It is the join/leave wiring
+// lockRendezvous's candidate set depends on; without it liveStages would
+// stay empty forever and lockRendezvous would always fall back to
+// lockLegacy.
+func (mapr *mapper) pollLiveStages() {
+	refresh := func() {
+		if err := mapr.ctx.stage.registery.Heartbeat(mapr.ctx.stage.Id()); err != nil {
+			glog.Errorf("Cannot heartbeat stage %v: %v", mapr.ctx.stage.Id(), err)
+		}
+
+		stages, err := mapr.ctx.stage.registery.Stages()
+		if err != nil {
+			glog.Errorf("Cannot refresh live stages: %v", err)
+			return
+		}
+
+		// rehomeDeparted writes liveStages and reads/migrates idToRcvrs,
+		// both of which only handleCmd's goroutine may touch; hand the
+		// refreshed set to it via refreshStagesCmd instead of calling it
+		// from this poller goroutine directly. resCh is nil, same as the
+		// other fire-and-forget cmd (stopCmd from stopReceivers): nothing
+		// here waits on a result.
+		mapr.ctrlCh <- routineCmd{refreshStagesCmd, stages, nil}
+	}
+
+	refresh()
+
+	ticker := time.NewTicker(stagePollInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		refresh()
+	}
+}
+
+// rehomeDeparted installs current as the new candidate set and migrates
+// every local map set whose rendezvous winner over current is another
+// stage, e.g. a stage that has joined and now scores highest, or a map set
+// that lockLegacy placed here. Map sets owned by a stage that has left are
+// held on that stage, not here, so they are not re-homed by this method.
+func (mapr *mapper) rehomeDeparted(current []StageId) {
+	mapr.setLiveStages(current)
+	if len(current) == 0 {
+		return
+	}
+
+	pf := mapr.placementFunc()
+	for id, rcvr := range mapr.idToRcvrs {
+		if !mapr.isLocalRcvr(id) {
+			continue
+		}
+
+		mapSet := mapr.mapSetOfRcvr(id)
+		if len(mapSet) == 0 {
+			continue
+		}
+
+		winner := pickStage(pf, id.ActorName, mapSet, current)
+		if winner == id.StageId {
+			continue
+		}
+
+		resCh := make(chan asyncResult, 1)
+		mapr.migrate(rcvr.id(), winner, resCh)
+	}
+}
+
 func (mapr *mapper) lockKey(dk DictionaryKey, rcvr receiver) bool {
 	mapr.setReceiver(dk, rcvr)
 	if mapr.ctx.stage.isIsol() {
 		return true
 	}
 
-	mapr.ctx.stage.registery.storeOrGet(rcvr.id(), []DictionaryKey{dk})
+	mapr.ctx.stage.registery.StoreOrGet(rcvr.id(), []DictionaryKey{dk})
 
 	return true
 }
@@ -352,6 +548,30 @@ func (mapr *mapper) newReceiverForMapSet(mapSet MapSet) receiver {
 	return rcvr
 }
 
+// restoreState runs restoreStateCmd: it restores req's snapshot into the
+// receiver it names via the state's Snapshotter, the same way
+// handleTransferStateReq used to do straight from the migrate connection's
+// goroutine. It is dispatched through ctrlCh instead, since receiverById,
+// mapSetOfRcvr and state() all touch fields only handleCmd's goroutine may
+// mutate.
+func (mapr *mapper) restoreState(req transferStateReq, resCh chan asyncResult) {
+	rcvr, ok := mapr.receiverById(req.Id)
+	if !ok {
+		resCh <- asyncResult{nil, fmt.Errorf("unknown receiver %+v", req.Id)}
+		return
+	}
+
+	if s, ok := mapr.state().(Snapshotter); ok {
+		mapSet := mapr.mapSetOfRcvr(rcvr.id())
+		if err := s.Restore(mapSet, req.Snapshot); err != nil {
+			resCh <- asyncResult{nil, err}
+			return
+		}
+	}
+
+	resCh <- asyncResult{nil, nil}
+}
+
 func (mapr *mapper) mapSetOfRcvr(id RcvrId) MapSet {
 	ms := MapSet{}
 	for k, r := range mapr.keyToRcvrs {
@@ -386,34 +606,21 @@ func (mapr *mapper) migrate(rcvrId RcvrId, to StageId, resCh chan asyncResult) {
 
 	glog.V(2).Infof("Received stopped: %+v", oldRcvr)
 
-	// TODO(soheil): There is a possibility of a deadlock. If the number of
-	// migrrations pass the control channel's buffer size.
-	conn, err := dialStage(to)
-	if err != nil {
-		resCh <- asyncResult{nil, err}
-		return
-	}
-
-	defer conn.Close()
-
-	enc := gob.NewEncoder(conn)
-	dec := gob.NewDecoder(conn)
-
-	if err := enc.Encode(stageHandshake{ctrlHandshake}); err != nil {
-		glog.Errorf("Cannot encode handshake: %+v", err)
-		resCh <- asyncResult{nil, err}
-		return
-	}
+	mapSet := mapr.mapSetOfRcvr(oldRcvr.id())
 
-	id := RcvrId{StageId: to, ActorName: rcvrId.ActorName}
-	if err := enc.Encode(stageRemoteCommand{newRcvrCmd, id}); err != nil {
-		glog.Errorf("Cannot encode command: %+v", err)
-		resCh <- asyncResult{nil, err}
-		return
+	var snapshot []byte
+	if s, ok := mapr.state().(Snapshotter); ok {
+		if snap, serr := s.Snapshot(mapSet); serr != nil {
+			glog.Errorf("Cannot snapshot state for %+v: %v", mapSet, serr)
+		} else {
+			snapshot = snap
+		}
 	}
 
-	if err := dec.Decode(&id); err != nil {
-		glog.V(2).Infof("Cannot decode the new receiver: %+v", err)
+	// TODO(soheil): There is a possibility of a deadlock. If the number of
+	// migrrations pass the control channel's buffer size.
+	id, err := mapr.dialNewRcvr(to, rcvrId.ActorName, snapshot)
+	if err != nil {
 		resCh <- asyncResult{nil, err}
 		return
 	}
@@ -428,8 +635,7 @@ func (mapr *mapper) migrate(rcvrId RcvrId, to StageId, resCh chan asyncResult) {
 
 	glog.V(2).Infof("Created a proxy for the new receiver: %+v", newRcvr)
 
-	mapSet := mapr.mapSetOfRcvr(oldRcvr.id())
-	mapr.ctx.stage.registery.set(newRcvr.id(), mapSet)
+	mapr.ctx.stage.registery.Set(newRcvr.id(), mapSet)
 
 	glog.V(2).Infof("Locked the mapset %+v for %+v", mapSet, newRcvr)
 
@@ -438,4 +644,94 @@ func (mapr *mapper) migrate(rcvrId RcvrId, to StageId, resCh chan asyncResult) {
 	}
 
 	go newRcvr.start()
+}
+
+// dialNewRcvr asks stage to to create (or find) a receiver for actorName,
+// optionally handing it snapshot to resume from, and returns its ID. It is
+// the handshake shared by migrate, which moves an existing receiver
+// explicitly, and lockRendezvous, which proxies to a remote rendezvous
+// winner (with a nil snapshot, since there is nothing to resume).
+//
+// By default it speaks the msgpack-framed protocol in migrate_protocol.go,
+// which negotiates a capability set before sending any command; set
+// legacyMigrateProto to fall back to the old untyped gob exchange for
+// peers that haven't rolled the new protocol out yet.
+func (mapr *mapper) dialNewRcvr(to StageId, actorName ActorName,
+	snapshot []byte) (RcvrId, error) {
+
+	if mapr.legacyMigrateProto {
+		return mapr.dialNewRcvrGob(to, actorName)
+	}
+	return mapr.dialNewRcvrV2(to, actorName, snapshot)
+}
+
+// dialNewRcvrV2 implements dialNewRcvr's default, capability-negotiated
+// msgpack protocol.
+func (mapr *mapper) dialNewRcvrV2(to StageId, actorName ActorName,
+	snapshot []byte) (RcvrId, error) {
+
+	conn, err := dialStage(to)
+	if err != nil {
+		return RcvrId{}, err
+	}
+	defer conn.Close()
+
+	caps, err := negotiateMigrate(conn, mapr.ctx.stage.Id())
+	if err != nil {
+		return RcvrId{}, err
+	}
+
+	if !caps[capMigrate] {
+		writeMigrateFrame(conn, abortReqCmd,
+			abortReq{Reason: fmt.Sprintf("peer %v lacks %q capability", to, capMigrate)})
+		return RcvrId{}, fmt.Errorf("migrate: peer %v lacks %q capability", to, capMigrate)
+	}
+
+	id, err := requestNewRcvr(conn, actorName)
+	if err != nil {
+		return RcvrId{}, err
+	}
+
+	if len(snapshot) > 0 && caps[capStateTransfer] {
+		if err := sendStateTransfer(conn, id, snapshot); err != nil {
+			glog.Errorf("Cannot transfer state to %v for %+v, resuming empty: %v",
+				to, id, err)
+		}
+	}
+
+	return id, nil
+}
+
+// dialNewRcvrGob is the pre-migrateHello wire format: a raw gob-encoded
+// stageHandshake followed by a stageRemoteCommand, with no version or
+// capability negotiation. Kept only for legacyMigrateProto.
+func (mapr *mapper) dialNewRcvrGob(to StageId, actorName ActorName) (RcvrId,
+	error) {
+
+	conn, err := dialStage(to)
+	if err != nil {
+		return RcvrId{}, err
+	}
+	defer conn.Close()
+
+	enc := gob.NewEncoder(conn)
+	dec := gob.NewDecoder(conn)
+
+	if err := enc.Encode(stageHandshake{ctrlHandshake}); err != nil {
+		glog.Errorf("Cannot encode handshake: %+v", err)
+		return RcvrId{}, err
+	}
+
+	id := RcvrId{StageId: to, ActorName: actorName}
+	if err := enc.Encode(stageRemoteCommand{newRcvrCmd, id}); err != nil {
+		glog.Errorf("Cannot encode command: %+v", err)
+		return RcvrId{}, err
+	}
+
+	if err := dec.Decode(&id); err != nil {
+		glog.V(2).Infof("Cannot decode the new receiver: %+v", err)
+		return RcvrId{}, err
+	}
+
+	return id, nil
 }
\ No newline at end of file
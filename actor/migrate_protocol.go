@@ -0,0 +1,330 @@
+package actor
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/golang/glog"
+	"github.com/vmihailenco/msgpack"
+)
+
+// migrateProtoVersion is bumped whenever the frame layout or a command
+// payload changes in a way that is not wire-compatible.
+const migrateProtoVersion = 1
+
+// Capabilities a stage can advertise in its migrateHello. Commands that
+// depend on one are only sent once it appears in both sides' intersection.
+const (
+	capMigrate         = "migrate"
+	capBulkMigrate     = "bulk-migrate"
+	capStateTransfer   = "state-transfer"
+	capSnapshotCompress = "snapshot-compress"
+)
+
+// migrateHello is the first frame on a migration connection. Each side
+// sends its own migrateHello, then both compute the intersection of Caps;
+// nothing beyond that intersection may be used for the rest of the
+// session. This replaces the old stageHandshake, which carried no version
+// or capability information.
+type migrateHello struct {
+	Version uint32
+	Caps    []string
+	StageId StageId
+}
+
+// migrateCmdType identifies the payload that follows a migrateFrame header.
+type migrateCmdType uint8
+
+const (
+	newRcvrReqCmd migrateCmdType = iota + 1
+	newRcvrResCmd
+	transferStateReqCmd
+	transferStateResCmd
+	abortReqCmd
+)
+
+// migrateFrame is the header written ahead of every command: CommandType
+// says how to decode Payload, Length lets a reader skip a command type it
+// does not understand instead of losing sync with the stream.
+type migrateFrame struct {
+	CommandType migrateCmdType
+	Length      uint32
+}
+
+// newRcvrReq asks the peer to create (or find) a receiver for ActorName.
+type newRcvrReq struct {
+	ActorName ActorName
+}
+
+// newRcvrRes is the peer's reply to newRcvrReq.
+type newRcvrRes struct {
+	Id RcvrId
+}
+
+// transferStateReq carries the dictionary snapshot of the receiver being
+// migrated, so the destination can resume it with its state intact rather
+// than starting empty. Snapshot is opaque to the protocol: it is whatever
+// mapr.ctx.state's codec produced for the receiver's MapSet.
+type transferStateReq struct {
+	Id       RcvrId
+	Snapshot []byte
+}
+
+// transferStateRes acknowledges a transferStateReq.
+type transferStateRes struct {
+	Ok    bool
+	Error string
+}
+
+// abortReq tells the peer to give up on the in-flight migration, e.g.
+// because capability negotiation left no usable command set.
+type abortReq struct {
+	Reason string
+}
+
+func writeMigrateFrame(w io.Writer, cmd migrateCmdType, v interface{}) error {
+	payload, err := msgpack.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	if err := binary.Write(w, binary.BigEndian, uint8(cmd)); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.BigEndian, uint32(len(payload))); err != nil {
+		return err
+	}
+	_, err = w.Write(payload)
+	return err
+}
+
+func readMigrateFrame(r io.Reader) (migrateFrame, []byte, error) {
+	var f migrateFrame
+	var cmd uint8
+	if err := binary.Read(r, binary.BigEndian, &cmd); err != nil {
+		return f, nil, err
+	}
+	f.CommandType = migrateCmdType(cmd)
+
+	if err := binary.Read(r, binary.BigEndian, &f.Length); err != nil {
+		return f, nil, err
+	}
+
+	payload := make([]byte, f.Length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return f, nil, err
+	}
+
+	return f, payload, nil
+}
+
+// negotiateMigrate exchanges migrateHello frames over conn (msgpack-encoded)
+// and returns the set of capabilities both ends support.
+func negotiateMigrate(conn net.Conn, self StageId) (map[string]bool, error) {
+	enc := msgpack.NewEncoder(conn)
+	dec := msgpack.NewDecoder(conn)
+
+	hello := migrateHello{
+		Version: migrateProtoVersion,
+		Caps: []string{
+			capMigrate, capBulkMigrate, capStateTransfer, capSnapshotCompress,
+		},
+		StageId: self,
+	}
+
+	// Send our hello while reading the peer's, so neither side depends on
+	// the conn buffering a write before the peer starts reading.
+	sent := make(chan error, 1)
+	go func() { sent <- enc.Encode(hello) }()
+
+	var peer migrateHello
+	if err := dec.Decode(&peer); err != nil {
+		return nil, err
+	}
+	if err := <-sent; err != nil {
+		return nil, err
+	}
+
+	if peer.Version != migrateProtoVersion {
+		glog.V(2).Infof("migrate: peer %v speaks protocol v%d, we speak v%d",
+			peer.StageId, peer.Version, migrateProtoVersion)
+	}
+
+	mine := make(map[string]bool, len(hello.Caps))
+	for _, c := range hello.Caps {
+		mine[c] = true
+	}
+
+	shared := make(map[string]bool)
+	for _, c := range peer.Caps {
+		if mine[c] {
+			shared[c] = true
+		}
+	}
+
+	return shared, nil
+}
+
+// requestNewRcvr sends a typed newRcvrReq and decodes the matching
+// newRcvrRes, replacing the old untyped gob stageRemoteCommand/RcvrId pair.
+func requestNewRcvr(conn net.Conn, actorName ActorName) (RcvrId, error) {
+	if err := writeMigrateFrame(conn, newRcvrReqCmd, newRcvrReq{ActorName: actorName}); err != nil {
+		return RcvrId{}, err
+	}
+
+	f, payload, err := readMigrateFrame(conn)
+	if err != nil {
+		return RcvrId{}, err
+	}
+
+	if f.CommandType != newRcvrResCmd {
+		return RcvrId{}, fmt.Errorf("migrate: expected newRcvrRes, got %v", f.CommandType)
+	}
+
+	var res newRcvrRes
+	if err := msgpack.Unmarshal(payload, &res); err != nil {
+		return RcvrId{}, err
+	}
+
+	return res.Id, nil
+}
+
+// handleMigrateConn serves one incoming migration connection for mapr's
+// actor: it exchanges migrateHello with the peer (negotiateMigrate is
+// symmetric -- whichever side calls it first just gets there first, there is
+// no ordering requirement), then reads and dispatches migrateFrames until
+// the peer closes the connection or sends abortReqCmd. This is the
+// receiving half of dialNewRcvrV2/sendStateTransfer; wherever a stage's
+// listener sees the new framing (as opposed to the legacy gob
+// stageHandshake dialNewRcvrGob speaks) on an inbound connection, it should
+// hand the connection to this method.
+//
+// This method itself runs on whatever goroutine the listener handed the
+// connection to, so it may read/write the connection directly. But it must
+// never touch mapr's idToRcvrs/keyToRcvrs/ctx.state itself -- handleCmd's
+// select loop is the only synchronization those have. handleNewRcvrReq and
+// handleTransferStateReq below dispatch the actual state-touching work
+// through mapr.ctrlCh instead, and only use the connection goroutine to
+// decode the request and write the response frame.
+func (mapr *mapper) handleMigrateConn(conn net.Conn) error {
+	caps, err := negotiateMigrate(conn, mapr.ctx.stage.Id())
+	if err != nil {
+		return err
+	}
+
+	for {
+		f, payload, err := readMigrateFrame(conn)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		switch f.CommandType {
+		case newRcvrReqCmd:
+			if err := mapr.handleNewRcvrReq(conn, payload); err != nil {
+				return err
+			}
+
+		case transferStateReqCmd:
+			if !caps[capStateTransfer] {
+				writeMigrateFrame(conn, transferStateResCmd,
+					transferStateRes{Ok: false, Error: "state-transfer not negotiated"})
+				continue
+			}
+			if err := mapr.handleTransferStateReq(conn, payload); err != nil {
+				return err
+			}
+
+		case abortReqCmd:
+			var a abortReq
+			if err := msgpack.Unmarshal(payload, &a); err != nil {
+				return err
+			}
+			return fmt.Errorf("migrate: aborted by peer: %s", a.Reason)
+
+		default:
+			glog.Errorf("migrate: unknown command type %v, dropping %d bytes",
+				f.CommandType, f.Length)
+		}
+	}
+}
+
+// handleNewRcvrReq replies to a newRcvrReq the same way the legacy
+// newRcvrCmd control command does: by creating a fresh local receiver for
+// the requesting actor. It reuses newRcvrCmd itself, dispatched through
+// mapr.ctrlCh, rather than calling mapr.newLocalReceiver() directly from
+// this connection's goroutine -- idToRcvrs is only ever safe to mutate from
+// handleCmd's own goroutine.
+func (mapr *mapper) handleNewRcvrReq(conn net.Conn, payload []byte) error {
+	var req newRcvrReq
+	if err := msgpack.Unmarshal(payload, &req); err != nil {
+		return err
+	}
+
+	resCh := make(chan asyncResult, 1)
+	mapr.ctrlCh <- routineCmd{newRcvrCmd, nil, resCh}
+	v, err := (<-resCh).get()
+	if err != nil {
+		return err
+	}
+
+	id := v.(RcvrId)
+	glog.V(2).Infof("Created a new local receiver for migration: %+v", id)
+
+	return writeMigrateFrame(conn, newRcvrResCmd, newRcvrRes{Id: id})
+}
+
+// handleTransferStateReq restores req's snapshot into the receiver it names,
+// replying Ok or an error either way so the sender never blocks waiting on a
+// response that never comes. The restore itself runs on the mapper's own
+// goroutine (mapr.restoreState, dispatched via restoreStateCmd) since it
+// reads idToRcvrs and ctx.state, which this connection's goroutine must not
+// touch directly.
+func (mapr *mapper) handleTransferStateReq(conn net.Conn, payload []byte) error {
+	var req transferStateReq
+	if err := msgpack.Unmarshal(payload, &req); err != nil {
+		return err
+	}
+
+	resCh := make(chan asyncResult, 1)
+	mapr.ctrlCh <- routineCmd{restoreStateCmd, req, resCh}
+	if _, err := (<-resCh).get(); err != nil {
+		return writeMigrateFrame(conn, transferStateResCmd,
+			transferStateRes{Ok: false, Error: err.Error()})
+	}
+
+	return writeMigrateFrame(conn, transferStateResCmd, transferStateRes{Ok: true})
+}
+
+// sendStateTransfer ships snapshot for id, only meaningful once both sides
+// have negotiated capStateTransfer.
+func sendStateTransfer(conn net.Conn, id RcvrId, snapshot []byte) error {
+	if err := writeMigrateFrame(conn, transferStateReqCmd,
+		transferStateReq{Id: id, Snapshot: snapshot}); err != nil {
+		return err
+	}
+
+	f, payload, err := readMigrateFrame(conn)
+	if err != nil {
+		return err
+	}
+
+	if f.CommandType != transferStateResCmd {
+		return fmt.Errorf("migrate: expected transferStateRes, got %v", f.CommandType)
+	}
+
+	var res transferStateRes
+	if err := msgpack.Unmarshal(payload, &res); err != nil {
+		return err
+	}
+
+	if !res.Ok {
+		return fmt.Errorf("migrate: peer rejected state transfer for %+v: %s", id, res.Error)
+	}
+
+	return nil
+}
@@ -0,0 +1,75 @@
+package actor
+
+import (
+	"net"
+	"testing"
+
+	"github.com/vmihailenco/msgpack"
+)
+
+func TestNegotiateMigrateIntersection(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	var sid StageId // zero value; only the intersection logic is under test
+
+	type result struct {
+		caps map[string]bool
+		err  error
+	}
+	doneA := make(chan result, 1)
+	doneB := make(chan result, 1)
+
+	go func() {
+		caps, err := negotiateMigrate(a, sid)
+		doneA <- result{caps, err}
+	}()
+	go func() {
+		caps, err := negotiateMigrate(b, sid)
+		doneB <- result{caps, err}
+	}()
+
+	ra, rb := <-doneA, <-doneB
+	if ra.err != nil || rb.err != nil {
+		t.Fatalf("negotiateMigrate errored: %v / %v", ra.err, rb.err)
+	}
+
+	want := []string{capMigrate, capBulkMigrate, capStateTransfer, capSnapshotCompress}
+	for _, c := range want {
+		if !ra.caps[c] || !rb.caps[c] {
+			t.Errorf("expected capability %q in both intersections, got %v / %v",
+				c, ra.caps, rb.caps)
+		}
+	}
+}
+
+func TestWriteReadMigrateFrameRoundTrip(t *testing.T) {
+	r, w := net.Pipe()
+	defer r.Close()
+	defer w.Close()
+
+	type payload struct {
+		A int
+		B string
+	}
+	want := payload{A: 42, B: "hello"}
+
+	go writeMigrateFrame(w, newRcvrReqCmd, want)
+
+	f, raw, err := readMigrateFrame(r)
+	if err != nil {
+		t.Fatalf("readMigrateFrame: %v", err)
+	}
+	if f.CommandType != newRcvrReqCmd {
+		t.Fatalf("command type = %v, want %v", f.CommandType, newRcvrReqCmd)
+	}
+
+	var got payload
+	if err := msgpack.Unmarshal(raw, &got); err != nil {
+		t.Fatalf("msgpack.Unmarshal: %v", err)
+	}
+	if got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
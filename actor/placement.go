@@ -0,0 +1,56 @@
+package actor
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/OneOfOne/xxhash"
+)
+
+// PlacementFunc scores how well-suited stage is to own ms for actor. Given
+// the same (actor, ms, stage) every stage computes the same score, so the
+// stage with the highest score across a candidate set -- the "highest
+// random weight" rule -- is agreed on without any coordination.
+type PlacementFunc func(actor ActorName, ms MapSet, stage StageId) uint64
+
+// Placer lets an Actor implementation override the default rendezvous hash
+// used to place its MapSets, e.g. to weight some stages more heavily than
+// others. PlaceMapSet's signature matches PlacementFunc exactly (modulo the
+// receiver) so a Placer's method value can be used as one directly.
+type Placer interface {
+	PlaceMapSet(actor ActorName, ms MapSet, stage StageId) uint64
+}
+
+// rendezvousScore is the default PlacementFunc. It hashes the actor name,
+// the sorted MapSet and the candidate stage with xxhash, so placement only
+// depends on the inputs and not on write order.
+func rendezvousScore(actor ActorName, ms MapSet, stage StageId) uint64 {
+	sort.Sort(ms)
+
+	h := xxhash.New64()
+	fmt.Fprintf(h, "%s", actor)
+	for _, dk := range ms {
+		fmt.Fprintf(h, "|%s/%s", dk.Dict, dk.Key)
+	}
+	fmt.Fprintf(h, "#%v", stage)
+
+	return h.Sum64()
+}
+
+// pickStage returns the candidate with the highest pf score for (actor,
+// ms). candidates must be non-empty.
+func pickStage(pf PlacementFunc, actor ActorName, ms MapSet,
+	candidates []StageId) StageId {
+
+	var winner StageId
+	var best uint64
+	for i, s := range candidates {
+		score := pf(actor, ms, s)
+		if i == 0 || score > best {
+			best = score
+			winner = s
+		}
+	}
+
+	return winner
+}
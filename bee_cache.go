@@ -0,0 +1,271 @@
+package beehive
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	redis "github.com/go-redis/redis"
+)
+
+// sharedCache is the tier-2 backend an lruCache can fall through to when a
+// key isn't resident locally, so many hives resolving the same hot bee
+// share one lookup instead of each hitting the registry. redisSharedCache
+// below is the reference implementation; memcached or an in-cluster gossip
+// cache could satisfy this interface just as well.
+type sharedCache interface {
+	get(key string) ([]byte, bool)
+	set(key string, value []byte)
+	del(key string)
+}
+
+type lruEntry struct {
+	key     string
+	value   []byte
+	expires time.Time
+}
+
+// lruCache is a size- and TTL-bounded local cache with an optional
+// sharedCache behind it. Local and shared hits/misses are counted
+// separately so operators can see how much load the shared tier is
+// actually absorbing.
+type lruCache struct {
+	mu     sync.Mutex
+	cap    int
+	ttl    time.Duration
+	ll     *list.List
+	items  map[string]*list.Element
+	shared sharedCache
+
+	localHits, localMisses   uint64
+	sharedHits, sharedMisses uint64
+}
+
+func newLRUCache(capacity int, ttl time.Duration, shared sharedCache) *lruCache {
+	return &lruCache{
+		cap:    capacity,
+		ttl:    ttl,
+		ll:     list.New(),
+		items:  make(map[string]*list.Element),
+		shared: shared,
+	}
+}
+
+func (c *lruCache) get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	if el, ok := c.items[key]; ok {
+		e := el.Value.(*lruEntry)
+		if c.ttl == 0 || time.Now().Before(e.expires) {
+			c.ll.MoveToFront(el)
+			c.localHits++
+			v := e.value
+			c.mu.Unlock()
+			return v, true
+		}
+		c.removeLocked(el)
+	}
+	c.localMisses++
+	c.mu.Unlock()
+
+	if c.shared == nil {
+		return nil, false
+	}
+
+	v, ok := c.shared.get(key)
+	if !ok {
+		atomic.AddUint64(&c.sharedMisses, 1)
+		return nil, false
+	}
+
+	atomic.AddUint64(&c.sharedHits, 1)
+	c.setLocal(key, v)
+	return v, true
+}
+
+func (c *lruCache) set(key string, value []byte) {
+	c.setLocal(key, value)
+	if c.shared != nil {
+		c.shared.set(key, value)
+	}
+}
+
+func (c *lruCache) setLocal(key string, value []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		e := el.Value.(*lruEntry)
+		e.value = value
+		e.expires = time.Now().Add(c.ttl)
+		c.ll.MoveToFront(el)
+		return
+	}
+
+	el := c.ll.PushFront(&lruEntry{
+		key:     key,
+		value:   value,
+		expires: time.Now().Add(c.ttl),
+	})
+	c.items[key] = el
+
+	if c.cap > 0 && c.ll.Len() > c.cap {
+		if oldest := c.ll.Back(); oldest != nil {
+			c.removeLocked(oldest)
+		}
+	}
+}
+
+// del evicts key from both tiers.
+func (c *lruCache) del(key string) {
+	c.mu.Lock()
+	if el, ok := c.items[key]; ok {
+		c.removeLocked(el)
+	}
+	c.mu.Unlock()
+
+	if c.shared != nil {
+		c.shared.del(key)
+	}
+}
+
+func (c *lruCache) removeLocked(el *list.Element) {
+	c.ll.Remove(el)
+	delete(c.items, el.Value.(*lruEntry).key)
+}
+
+// counts returns the running hit/miss counters for both tiers.
+func (c *lruCache) counts() (localHits, localMisses, sharedHits, sharedMisses uint64) {
+	c.mu.Lock()
+	localHits, localMisses = c.localHits, c.localMisses
+	c.mu.Unlock()
+	return localHits, localMisses, atomic.LoadUint64(&c.sharedHits),
+		atomic.LoadUint64(&c.sharedMisses)
+}
+
+// beeLookupCache caches bee ID -> BeeInfo (which hive currently owns the
+// bee), fronting p.hive.bee.
+type beeLookupCache struct {
+	*lruCache
+
+	// known tracks every bee ID currently cached so rpcClientPool's
+	// cache-watch loop can re-validate them against the registry without
+	// having to enumerate the underlying lruCache's string keys.
+	knownMu sync.Mutex
+	known   map[uint64]struct{}
+}
+
+func newBeeLookupCache(capacity int, ttl time.Duration, shared sharedCache) *beeLookupCache {
+	return &beeLookupCache{
+		lruCache: newLRUCache(capacity, ttl, shared),
+		known:    make(map[uint64]struct{}),
+	}
+}
+
+func (c *beeLookupCache) getBee(bee uint64) (info BeeInfo, ok bool) {
+	raw, ok := c.get(beeCacheKey(bee))
+	if !ok {
+		return BeeInfo{}, false
+	}
+	if err := gobDecode(raw, &info); err != nil {
+		return BeeInfo{}, false
+	}
+	return info, true
+}
+
+func (c *beeLookupCache) setBee(bee uint64, info BeeInfo) {
+	c.set(beeCacheKey(bee), gobEncode(info))
+	c.knownMu.Lock()
+	c.known[bee] = struct{}{}
+	c.knownMu.Unlock()
+}
+
+func (c *beeLookupCache) delBee(bee uint64) {
+	c.del(beeCacheKey(bee))
+	c.knownMu.Lock()
+	delete(c.known, bee)
+	c.knownMu.Unlock()
+}
+
+// knownBees returns every bee ID currently (or recently) cached, for the
+// cache-watch loop to re-validate.
+func (c *beeLookupCache) knownBees() []uint64 {
+	c.knownMu.Lock()
+	defer c.knownMu.Unlock()
+
+	bees := make([]uint64, 0, len(c.known))
+	for b := range c.known {
+		bees = append(bees, b)
+	}
+	return bees
+}
+
+func beeCacheKey(bee uint64) string {
+	return fmt.Sprintf("beehive/bee/%d", bee)
+}
+
+// hiveLookupCache caches hive ID -> HiveInfo (its dial address), fronting
+// p.hive.registry.hive the same way beeLookupCache fronts p.hive.bee.
+type hiveLookupCache struct {
+	*lruCache
+}
+
+func newHiveLookupCache(capacity int, ttl time.Duration, shared sharedCache) *hiveLookupCache {
+	return &hiveLookupCache{lruCache: newLRUCache(capacity, ttl, shared)}
+}
+
+func (c *hiveLookupCache) getHive(hive uint64) (info HiveInfo, ok bool) {
+	raw, ok := c.get(hiveCacheKey(hive))
+	if !ok {
+		return HiveInfo{}, false
+	}
+	if err := gobDecode(raw, &info); err != nil {
+		return HiveInfo{}, false
+	}
+	return info, true
+}
+
+func (c *hiveLookupCache) setHive(hive uint64, info HiveInfo) {
+	c.set(hiveCacheKey(hive), gobEncode(info))
+}
+
+func (c *hiveLookupCache) delHive(hive uint64) {
+	c.del(hiveCacheKey(hive))
+}
+
+func hiveCacheKey(hive uint64) string {
+	return fmt.Sprintf("beehive/hive/%d", hive)
+}
+
+// redisSharedCache is the out-of-the-box sharedCache backend: a Redis
+// instance shared by every hive in the cluster, so a bee that many hives
+// talk to only costs one registry lookup cluster-wide per TTL instead of
+// one per hive.
+type redisSharedCache struct {
+	client *redis.Client
+	ttl    time.Duration
+}
+
+func newRedisSharedCache(addr string, ttl time.Duration) *redisSharedCache {
+	return &redisSharedCache{
+		client: redis.NewClient(&redis.Options{Addr: addr}),
+		ttl:    ttl,
+	}
+}
+
+func (r *redisSharedCache) get(key string) ([]byte, bool) {
+	v, err := r.client.Get(key).Bytes()
+	if err != nil {
+		return nil, false
+	}
+	return v, true
+}
+
+func (r *redisSharedCache) set(key string, value []byte) {
+	r.client.Set(key, value, r.ttl)
+}
+
+func (r *redisSharedCache) del(key string) {
+	r.client.Del(key)
+}
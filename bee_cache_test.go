@@ -0,0 +1,100 @@
+package beehive
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLRUCacheGetSetDel(t *testing.T) {
+	c := newLRUCache(2, time.Minute, nil)
+
+	if _, ok := c.get("a"); ok {
+		t.Fatalf("get on empty cache returned ok")
+	}
+
+	c.set("a", []byte("1"))
+	if v, ok := c.get("a"); !ok || string(v) != "1" {
+		t.Fatalf("get(a) = %q, %v; want \"1\", true", v, ok)
+	}
+
+	c.del("a")
+	if _, ok := c.get("a"); ok {
+		t.Fatalf("get(a) after del still ok")
+	}
+}
+
+func TestLRUCacheEvictsOverCapacity(t *testing.T) {
+	c := newLRUCache(2, time.Minute, nil)
+
+	c.set("a", []byte("1"))
+	c.set("b", []byte("2"))
+	c.set("c", []byte("3")) // evicts "a", the least recently used
+
+	if _, ok := c.get("a"); ok {
+		t.Fatalf("get(a) still ok after capacity eviction")
+	}
+	if _, ok := c.get("b"); !ok {
+		t.Fatalf("get(b) evicted unexpectedly")
+	}
+	if _, ok := c.get("c"); !ok {
+		t.Fatalf("get(c) evicted unexpectedly")
+	}
+}
+
+func TestLRUCacheExpiresByTTL(t *testing.T) {
+	c := newLRUCache(0, time.Millisecond, nil)
+
+	c.set("a", []byte("1"))
+	time.Sleep(5 * time.Millisecond)
+
+	if _, ok := c.get("a"); ok {
+		t.Fatalf("get(a) still ok after its TTL elapsed")
+	}
+}
+
+type fakeShared struct {
+	values map[string][]byte
+}
+
+func (f *fakeShared) get(key string) ([]byte, bool) {
+	v, ok := f.values[key]
+	return v, ok
+}
+
+func (f *fakeShared) set(key string, value []byte) {
+	f.values[key] = value
+}
+
+func (f *fakeShared) del(key string) {
+	delete(f.values, key)
+}
+
+func TestLRUCacheFallsThroughToShared(t *testing.T) {
+	shared := &fakeShared{values: map[string][]byte{"a": []byte("1")}}
+	c := newLRUCache(0, time.Minute, shared)
+
+	v, ok := c.get("a")
+	if !ok || string(v) != "1" {
+		t.Fatalf("get(a) = %q, %v; want \"1\", true via shared fallback", v, ok)
+	}
+
+	// The shared hit should have been promoted into the local tier, so a
+	// second get doesn't need the shared backend at all.
+	delete(shared.values, "a")
+	if v, ok := c.get("a"); !ok || string(v) != "1" {
+		t.Fatalf("get(a) after shared eviction = %q, %v; want local hit", v, ok)
+	}
+}
+
+func TestLRUCacheCounts(t *testing.T) {
+	c := newLRUCache(0, time.Minute, nil)
+
+	c.get("missing")
+	c.set("a", []byte("1"))
+	c.get("a")
+
+	lh, lm, _, _ := c.counts()
+	if lh != 1 || lm != 1 {
+		t.Fatalf("counts() = hits %d, misses %d; want 1, 1", lh, lm)
+	}
+}
@@ -0,0 +1,310 @@
+// Package beehivepb is the Go counterpart of transport.proto, hand-written
+// rather than protoc-generated: this checkout has no protoc toolchain wired
+// in yet (TODO: add one and regenerate from transport.proto once it is).
+// Rather than have every message implement proto.Message, the client and
+// server below install a gob grpc.Codec: each message struct is itself
+// gob-encoded on the wire, and its Payload field holds the gob bytes
+// grpc.go produces -- swapping in real
+// protoc-gen-go output later only changes how these types are produced, not
+// how they are used by grpc.go.
+package beehivepb
+
+import (
+	"bytes"
+	"encoding/gob"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+// Empty, MsgBatch, RaftBatch, Cmd, CmdResult and HiveStateMsg mirror the
+// messages in transport.proto; see there for field-level docs.
+type Empty struct{}
+
+type MsgBatch struct{ Payload []byte }
+
+type RaftBatch struct{ Payload []byte }
+
+type Cmd struct{ Payload []byte }
+
+type CmdResult struct{ Payload []byte }
+
+type HiveStateMsg struct{ Payload []byte }
+
+const serviceName = "beehivepb.Transport"
+
+// codec implements grpc.Codec by gob-encoding whatever struct it is given,
+// so Empty/MsgBatch/etc. need not implement proto.Message.
+type codec struct{}
+
+func (codec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (codec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+func (codec) String() string { return "gob" }
+
+// DialOption returns the grpc.DialOption a client must pass to grpc.Dial so
+// its wire format matches NewServer below.
+func DialOption() grpc.DialOption {
+	return grpc.WithCodec(codec{})
+}
+
+// NewServer returns a *grpc.Server configured with the same codec DialOption
+// uses, plus any caller-supplied options.
+func NewServer(opts ...grpc.ServerOption) *grpc.Server {
+	return grpc.NewServer(append(opts, grpc.CustomCodec(codec{}))...)
+}
+
+// TransportClient is the client API for the Transport service.
+type TransportClient interface {
+	EnqueMsg(ctx context.Context, opts ...grpc.CallOption) (Transport_EnqueMsgClient, error)
+	ProcessRaft(ctx context.Context, opts ...grpc.CallOption) (Transport_ProcessRaftClient, error)
+	ProcessCmd(ctx context.Context, in *Cmd, opts ...grpc.CallOption) (*CmdResult, error)
+	HiveState(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*HiveStateMsg, error)
+}
+
+type transportClient struct {
+	cc *grpc.ClientConn
+}
+
+// NewTransportClient wraps an already-dialed connection. cc must have been
+// dialed with DialOption() for the wire format to match the server.
+func NewTransportClient(cc *grpc.ClientConn) TransportClient {
+	return &transportClient{cc: cc}
+}
+
+func (c *transportClient) ProcessCmd(ctx context.Context, in *Cmd,
+	opts ...grpc.CallOption) (*CmdResult, error) {
+
+	out := new(CmdResult)
+	if err := grpc.Invoke(ctx, "/"+serviceName+"/ProcessCmd", in, out, c.cc, opts...); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *transportClient) HiveState(ctx context.Context, in *Empty,
+	opts ...grpc.CallOption) (*HiveStateMsg, error) {
+
+	out := new(HiveStateMsg)
+	if err := grpc.Invoke(ctx, "/"+serviceName+"/HiveState", in, out, c.cc, opts...); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+var streamDescEnqueMsg = &grpc.StreamDesc{
+	StreamName:    "EnqueMsg",
+	ClientStreams: true,
+}
+
+var streamDescProcessRaft = &grpc.StreamDesc{
+	StreamName:    "ProcessRaft",
+	ClientStreams: true,
+	ServerStreams: true,
+}
+
+// Transport_EnqueMsgClient is the client-stream handle EnqueMsg returns.
+type Transport_EnqueMsgClient interface {
+	Send(*MsgBatch) error
+	CloseAndRecv() (*Empty, error)
+	grpc.ClientStream
+}
+
+type transportEnqueMsgClient struct {
+	grpc.ClientStream
+}
+
+func (c *transportClient) EnqueMsg(ctx context.Context, opts ...grpc.CallOption) (
+	Transport_EnqueMsgClient, error) {
+
+	stream, err := grpc.NewClientStream(ctx, streamDescEnqueMsg, c.cc,
+		"/"+serviceName+"/EnqueMsg", opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &transportEnqueMsgClient{stream}, nil
+}
+
+func (x *transportEnqueMsgClient) Send(m *MsgBatch) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *transportEnqueMsgClient) CloseAndRecv() (*Empty, error) {
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	m := new(Empty)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Transport_ProcessRaftClient is the bidi-stream handle ProcessRaft returns.
+type Transport_ProcessRaftClient interface {
+	Send(*RaftBatch) error
+	Recv() (*Empty, error)
+	grpc.ClientStream
+}
+
+type transportProcessRaftClient struct {
+	grpc.ClientStream
+}
+
+func (c *transportClient) ProcessRaft(ctx context.Context, opts ...grpc.CallOption) (
+	Transport_ProcessRaftClient, error) {
+
+	stream, err := grpc.NewClientStream(ctx, streamDescProcessRaft, c.cc,
+		"/"+serviceName+"/ProcessRaft", opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &transportProcessRaftClient{stream}, nil
+}
+
+func (x *transportProcessRaftClient) Send(m *RaftBatch) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *transportProcessRaftClient) Recv() (*Empty, error) {
+	m := new(Empty)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// TransportServer is the server API for the Transport service.
+type TransportServer interface {
+	EnqueMsg(Transport_EnqueMsgServer) error
+	ProcessRaft(Transport_ProcessRaftServer) error
+	ProcessCmd(context.Context, *Cmd) (*CmdResult, error)
+	HiveState(context.Context, *Empty) (*HiveStateMsg, error)
+}
+
+// Transport_EnqueMsgServer is the server-side handle for EnqueMsg's stream.
+type Transport_EnqueMsgServer interface {
+	Recv() (*MsgBatch, error)
+	SendAndClose(*Empty) error
+	grpc.ServerStream
+}
+
+type transportEnqueMsgServer struct {
+	grpc.ServerStream
+}
+
+func (x *transportEnqueMsgServer) Recv() (*MsgBatch, error) {
+	m := new(MsgBatch)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (x *transportEnqueMsgServer) SendAndClose(m *Empty) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Transport_EnqueMsg_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(TransportServer).EnqueMsg(&transportEnqueMsgServer{stream})
+}
+
+// Transport_ProcessRaftServer is the server-side handle for ProcessRaft's
+// bidi stream.
+type Transport_ProcessRaftServer interface {
+	Send(*Empty) error
+	Recv() (*RaftBatch, error)
+	grpc.ServerStream
+}
+
+type transportProcessRaftServer struct {
+	grpc.ServerStream
+}
+
+func (x *transportProcessRaftServer) Send(m *Empty) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *transportProcessRaftServer) Recv() (*RaftBatch, error) {
+	m := new(RaftBatch)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _Transport_ProcessRaft_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(TransportServer).ProcessRaft(&transportProcessRaftServer{stream})
+}
+
+func _Transport_ProcessCmd_Handler(srv interface{}, ctx context.Context,
+	dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+
+	in := new(Cmd)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TransportServer).ProcessCmd(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + serviceName + "/ProcessCmd"}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TransportServer).ProcessCmd(ctx, req.(*Cmd))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Transport_HiveState_Handler(srv interface{}, ctx context.Context,
+	dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+
+	in := new(Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TransportServer).HiveState(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + serviceName + "/HiveState"}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TransportServer).HiveState(ctx, req.(*Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+var transportServiceDesc = grpc.ServiceDesc{
+	ServiceName: serviceName,
+	HandlerType: (*TransportServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{MethodName: "ProcessCmd", Handler: _Transport_ProcessCmd_Handler},
+		{MethodName: "HiveState", Handler: _Transport_HiveState_Handler},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "EnqueMsg",
+			Handler:       _Transport_EnqueMsg_Handler,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "ProcessRaft",
+			Handler:       _Transport_ProcessRaft_Handler,
+			ClientStreams: true,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "transport.proto",
+}
+
+// RegisterTransportServer registers srv on s, which must have been built
+// with NewServer so its codec matches the client's DialOption.
+func RegisterTransportServer(s *grpc.Server, srv TransportServer) {
+	s.RegisterService(&transportServiceDesc, srv)
+}
@@ -0,0 +1,23 @@
+package beehivepb
+
+import "testing"
+
+func TestCodecRoundTrip(t *testing.T) {
+	c := codec{}
+
+	want := MsgBatch{Payload: []byte("hello")}
+
+	data, err := c.Marshal(&want)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+
+	var got MsgBatch
+	if err := c.Unmarshal(data, &got); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+
+	if string(got.Payload) != string(want.Payload) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,265 @@
+package actor
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+	"github.com/golang/glog"
+)
+
+// consulRegistry is a Registry backed by Consul's KV store. Locks are held
+// via a Consul session attached to the lock key, and StoreOrGet/Set use a
+// single KV transaction so a MapSet's keys are updated atomically.
+type consulRegistry struct {
+	client *consul.Client
+	prefix string
+	ttl    string
+
+	// sessionMu guards session: one Registry is shared across every actor's
+	// mapper in a stage, so Lock/Unlock for different actors run
+	// concurrently and would otherwise race on this map.
+	sessionMu sync.Mutex
+	session   map[ActorName]string
+}
+
+// newConsulRegistry dials the Consul agent at addr and returns a Registry
+// that stores actor placement under prefix.
+func newConsulRegistry(addr, prefix, ttl string) (*consulRegistry, error) {
+	cfg := consul.DefaultConfig()
+	cfg.Address = addr
+	client, err := consul.NewClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &consulRegistry{
+		client:  client,
+		prefix:  prefix,
+		ttl:     ttl,
+		session: make(map[ActorName]string),
+	}, nil
+}
+
+func (c *consulRegistry) path(elem ...string) string {
+	k := c.prefix
+	for _, e := range elem {
+		k += "/" + e
+	}
+	return k
+}
+
+func (c *consulRegistry) lockKey(actor ActorName) string {
+	return c.path(string(actor), lockFileName)
+}
+
+// Lock implements Registry.
+func (c *consulRegistry) Lock(id ReceiverId) error {
+	se := c.client.Session()
+	sid, _, err := se.Create(&consul.SessionEntry{
+		TTL:       c.ttl,
+		Behavior:  consul.SessionBehaviorDelete,
+	}, nil)
+	if err != nil {
+		return err
+	}
+
+	kv := c.client.KV()
+	k := c.lockKey(id.ActorName)
+	var waitIndex uint64
+	for {
+		acquired, _, err := kv.Acquire(&consul.KVPair{
+			Key:     k,
+			Value:   marshallRegValOrFail(regVal{StageId: id.StageId, RcvrId: id.RcvrId}),
+			Session: sid,
+		}, nil)
+		if err != nil {
+			return err
+		}
+
+		if acquired {
+			c.sessionMu.Lock()
+			c.session[id.ActorName] = sid
+			c.sessionMu.Unlock()
+			return nil
+		}
+
+		// Block until the lock key changes instead of busy-polling: a
+		// WaitIndex of 0 never blocks (any real Consul index is already
+		// greater), so Get would just spin against the agent. Passing the
+		// index we last observed makes Get block (up to Consul's default
+		// wait timeout) until a write advances it past that point.
+		_, meta, err := kv.Get(k, &consul.QueryOptions{WaitIndex: waitIndex})
+		if err != nil {
+			return err
+		}
+		if meta != nil {
+			waitIndex = meta.LastIndex
+		}
+	}
+}
+
+// Unlock implements Registry.
+func (c *consulRegistry) Unlock(id ReceiverId) error {
+	c.sessionMu.Lock()
+	sid, ok := c.session[id.ActorName]
+	c.sessionMu.Unlock()
+	if !ok {
+		return fmt.Errorf("consul-registry: no lock held for %v", id.ActorName)
+	}
+
+	kv := c.client.KV()
+	k := c.lockKey(id.ActorName)
+	if _, _, err := kv.Release(&consul.KVPair{Key: k, Session: sid}, nil); err != nil {
+		return err
+	}
+
+	c.sessionMu.Lock()
+	delete(c.session, id.ActorName)
+	c.sessionMu.Unlock()
+	return c.client.Session().Destroy(sid, nil)
+}
+
+// StoreOrGet implements Registry. It uses a single Consul transaction so
+// either every key in ms is created with id as its owner, or (if any key is
+// already owned) the existing owner is returned and nothing is written.
+func (c *consulRegistry) StoreOrGet(id ReceiverId, ms MapSet) regVal {
+	if err := c.Lock(id); err != nil {
+		glog.Errorf("consul-registry: cannot lock %v: %v", id.ActorName, err)
+		return regVal{StageId: id.StageId, RcvrId: id.RcvrId}
+	}
+	defer c.Unlock(id)
+
+	v := regVal{StageId: id.StageId, RcvrId: id.RcvrId}
+	kv := c.client.KV()
+	for _, dk := range ms {
+		k := c.path(string(id.ActorName), dk.Dict, dk.Key)
+		pair, _, err := kv.Get(k, nil)
+		if err != nil || pair == nil {
+			continue
+		}
+
+		resV := unmarshallRegValOrFail(string(pair.Value))
+		if !resV.Eq(&v) {
+			return resV
+		}
+	}
+
+	mv := marshallRegValOrFail(v)
+	var ops consul.KVTxnOps
+	for _, dk := range ms {
+		ops = append(ops, &consul.KVTxnOp{
+			Verb:  consul.KVSet,
+			Key:   c.path(string(id.ActorName), dk.Dict, dk.Key),
+			Value: []byte(mv),
+		})
+	}
+
+	if _, _, _, err := kv.Txn(ops, nil); err != nil {
+		glog.Errorf("consul-registry: transaction failed for %v: %v", id, err)
+	}
+
+	return v
+}
+
+// Set implements Registry.
+func (c *consulRegistry) Set(id ReceiverId, ms MapSet) regVal {
+	v := regVal{StageId: id.StageId, RcvrId: id.RcvrId}
+	mv := marshallRegValOrFail(v)
+
+	kv := c.client.KV()
+	var ops consul.KVTxnOps
+	for _, dk := range ms {
+		ops = append(ops, &consul.KVTxnOp{
+			Verb:  consul.KVSet,
+			Key:   c.path(string(id.ActorName), dk.Dict, dk.Key),
+			Value: []byte(mv),
+		})
+	}
+
+	if _, _, _, err := kv.Txn(ops, nil); err != nil {
+		glog.Errorf("consul-registry: transaction failed for %v: %v", id, err)
+	}
+
+	return v
+}
+
+// Get implements Registry.
+func (c *consulRegistry) Get(actor ActorName, dk DictionaryKey) (regVal, error) {
+	pair, _, err := c.client.KV().Get(c.path(string(actor), dk.Dict, dk.Key), nil)
+	if err != nil {
+		return regVal{}, err
+	}
+	if pair == nil {
+		return regVal{}, fmt.Errorf("consul-registry: no owner for %v/%v", actor, dk)
+	}
+	return unmarshallRegValOrFail(string(pair.Value)), nil
+}
+
+// Watch implements Registry. It blocks until the Consul index for dk's key
+// advances past the one last observed.
+func (c *consulRegistry) Watch(actor ActorName, dk DictionaryKey) error {
+	k := c.path(string(actor), dk.Dict, dk.Key)
+	_, meta, err := c.client.KV().Get(k, nil)
+	if err != nil {
+		return err
+	}
+
+	idx := uint64(0)
+	if meta != nil {
+		idx = meta.LastIndex
+	}
+
+	_, _, err = c.client.KV().Get(k, &consul.QueryOptions{WaitIndex: idx})
+	return err
+}
+
+// stageHeartbeat is what Heartbeat stores per stage; Consul's KV has no
+// built-in per-key TTL outside of sessions, so Stages filters these by age
+// itself instead.
+type stageHeartbeat struct {
+	ID   StageId
+	Seen int64 // unix seconds
+}
+
+func (c *consulRegistry) stageKey(id StageId) string {
+	return c.path(stagesDir, fmt.Sprintf("%v", id))
+}
+
+// Heartbeat implements Registry.
+func (c *consulRegistry) Heartbeat(id StageId) error {
+	hb := stageHeartbeat{ID: id, Seen: time.Now().Unix()}
+	v, err := json.Marshal(hb)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.client.KV().Put(&consul.KVPair{Key: c.stageKey(id), Value: v}, nil)
+	return err
+}
+
+// Stages implements Registry.
+func (c *consulRegistry) Stages() ([]StageId, error) {
+	pairs, _, err := c.client.KV().List(c.path(stagesDir), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	ttl, _ := time.ParseDuration(c.ttl)
+	cutoff := time.Now().Add(-ttl).Unix()
+
+	stages := make([]StageId, 0, len(pairs))
+	for _, p := range pairs {
+		var hb stageHeartbeat
+		if err := json.Unmarshal(p.Value, &hb); err != nil {
+			continue
+		}
+		if ttl > 0 && hb.Seen < cutoff {
+			continue
+		}
+		stages = append(stages, hb.ID)
+	}
+	return stages, nil
+}
@@ -0,0 +1,308 @@
+package beehive
+
+import (
+	"bytes"
+	"encoding/gob"
+	"io"
+	"net"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
+	"github.com/kandoo/beehive/Godeps/_workspace/src/golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/kandoo/beehive/beehivepb"
+	"github.com/kandoo/beehive/raft"
+)
+
+// raftPriorityHeader carries raft.Batch.Priority across the gRPC transport:
+// net/rpc gets the same effect for free by dialing a dedicated prio
+// connection, but a gRPC batch only has the one ProcessRaft stream, so the
+// priority has to ride along as a header instead.
+const (
+	raftPriorityHeader = "bh-raft-priority"
+	raftPriorityHigh   = "high"
+)
+
+// raftWorkers is how many raft batches grpcServer processes concurrently.
+// prioJobs and normalJobs are drained by the same pool of workers, each of
+// which always prefers a pending prioJobs entry, so a backlog of
+// normal-priority batches can never starve a high-priority one.
+const raftWorkers = 4
+
+// raftJob is one batch queued for a grpcServer worker, along with where to
+// deliver the result once rpcServer.ProcessRaft finishes with it.
+type raftJob struct {
+	batch raft.Batch
+	done  chan error
+}
+
+// Transport names accepted by HiveConfig.Transport. TransportGobRPC is the
+// default and matches the pre-existing net/rpc behavior; TransportGRPC
+// opts into the gRPC transport below, which carries all four surfaces over
+// one HTTP/2 connection and puts a per-call deadline on ProcessCmd and
+// HiveState. It dials without TLS (grpc.WithInsecure), and its payloads are
+// gob-encoded (see beehivepb), not protobuf.
+const (
+	TransportGobRPC = "gob-rpc"
+	TransportGRPC   = "grpc"
+)
+
+func gobEncode(v interface{}) []byte {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		glog.Fatalf("Cannot gob-encode %+v for grpc transport: %v", v, err)
+	}
+	return buf.Bytes()
+}
+
+func gobDecode(payload []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(payload)).Decode(v)
+}
+
+// grpcClient is the gRPC counterpart of rpcClient: a single HTTP/2
+// connection carries EnqueMsg, ProcessRaft, ProcessCmd and HiveState via
+// beehivepb.TransportClient, instead of the four net/rpc connections
+// rpcClient dials.
+type grpcClient struct {
+	addr string
+	conn *grpc.ClientConn
+	stub beehivepb.TransportClient
+}
+
+func newGRPCClient(addr string) (*grpcClient, error) {
+	conn, err := grpc.Dial(addr, grpc.WithInsecure(), grpc.WithTimeout(maxWait),
+		beehivepb.DialOption())
+	if err != nil {
+		return nil, err
+	}
+
+	return &grpcClient{
+		addr: addr,
+		conn: conn,
+		stub: beehivepb.NewTransportClient(conn),
+	}, nil
+}
+
+func (c *grpcClient) String() string {
+	return "grpc client to " + c.addr
+}
+
+// sendMsg implements transport by sending msgs as a single frame on the
+// EnqueMsg client-stream; the server drains the stream and acks once.
+func (c *grpcClient) sendMsg(msgs []msg) error {
+	stream, err := c.stub.EnqueMsg(context.Background())
+	if err != nil {
+		return err
+	}
+
+	if err := stream.Send(&beehivepb.MsgBatch{Payload: gobEncode(msgs)}); err != nil {
+		return err
+	}
+
+	_, err = stream.CloseAndRecv()
+	return err
+}
+
+func (c *grpcClient) sendCmd(cm cmd) (res interface{}, err error) {
+	ctx, cnl := context.WithTimeout(context.Background(), maxWait)
+	defer cnl()
+
+	reply, err := c.stub.ProcessCmd(ctx, &beehivepb.Cmd{Payload: gobEncode(cm)})
+	if err != nil {
+		return nil, err
+	}
+
+	var cmdRes cmdResult
+	if err := gobDecode(reply.Payload, &cmdRes); err != nil {
+		return nil, err
+	}
+	return cmdRes.Data, cmdRes.Err
+}
+
+// sendRaft implements transport over the bidi ProcessRaft stream: both
+// heartbeats and high-priority messages (raft.Batch.Priority) travel over
+// the same connection, so there is no separate priority dial to maintain
+// the way rpcClient needs one. A high-priority batch instead carries
+// raftPriorityHeader, which grpcServer.ProcessRaft uses to jump its own
+// processing queue ahead of normal-priority batches.
+func (c *grpcClient) sendRaft(batch *raft.Batch, r raft.Reporter) (err error) {
+	ctx := context.Background()
+	if batch.Priority == raft.High {
+		ctx = metadata.NewOutgoingContext(ctx,
+			metadata.Pairs(raftPriorityHeader, raftPriorityHigh))
+	}
+
+	stream, err := c.stub.ProcessRaft(ctx)
+	if err != nil {
+		report(err, batch, r)
+		return err
+	}
+	defer stream.CloseSend()
+
+	if err = stream.Send(&beehivepb.RaftBatch{Payload: gobEncode(batch)}); err != nil {
+		report(err, batch, r)
+		return err
+	}
+
+	_, err = stream.Recv()
+	report(err, batch, r)
+	return err
+}
+
+func (c *grpcClient) hiveState() (state HiveState, err error) {
+	ctx, cnl := context.WithTimeout(context.Background(), maxWait)
+	defer cnl()
+
+	reply, err := c.stub.HiveState(ctx, &beehivepb.Empty{})
+	if err != nil {
+		return HiveState{}, err
+	}
+
+	err = gobDecode(reply.Payload, &state)
+	return state, err
+}
+
+func (c *grpcClient) stop() {
+	c.conn.Close()
+}
+
+// grpcServer adapts rpcServer's four surfaces to beehivepb.TransportServer
+// so a hive can serve both the net/rpc and gRPC transports from the same
+// underlying handlers.
+type grpcServer struct {
+	s *rpcServer
+
+	prioJobs   chan raftJob
+	normalJobs chan raftJob
+}
+
+func newGRPCServer(h *hive) *grpcServer {
+	g := &grpcServer{
+		s:          newRPCServer(h),
+		prioJobs:   make(chan raftJob),
+		normalJobs: make(chan raftJob),
+	}
+	for i := 0; i < raftWorkers; i++ {
+		go g.runRaftJobs()
+	}
+	return g
+}
+
+// runRaftJobs is one of raftWorkers identical workers feeding
+// rpcServer.ProcessRaft. It always checks prioJobs first so a pending
+// high-priority batch is never left waiting behind a normal-priority one.
+func (g *grpcServer) runRaftJobs() {
+	for {
+		var j raftJob
+		select {
+		case j = <-g.prioJobs:
+		default:
+			select {
+			case j = <-g.prioJobs:
+			case j = <-g.normalJobs:
+			}
+		}
+
+		var dummy bool
+		j.done <- g.s.ProcessRaft(j.batch, &dummy)
+	}
+}
+
+// Serve registers g on a new beehivepb.NewServer (so its codec matches
+// newGRPCClient's DialOption) and blocks serving lis.
+func (g *grpcServer) Serve(lis net.Listener) error {
+	s := beehivepb.NewServer()
+	beehivepb.RegisterTransportServer(s, g)
+	return s.Serve(lis)
+}
+
+func (g *grpcServer) EnqueMsg(stream beehivepb.Transport_EnqueMsgServer) error {
+	for {
+		batch, err := stream.Recv()
+		if err == io.EOF {
+			return stream.SendAndClose(&beehivepb.Empty{})
+		}
+		if err != nil {
+			return err
+		}
+
+		var msgs []msg
+		if err := gobDecode(batch.Payload, &msgs); err != nil {
+			return err
+		}
+
+		var dummy struct{}
+		if err := g.s.EnqueMsg(msgs, &dummy); err != nil {
+			return err
+		}
+	}
+}
+
+// ProcessRaft relays each batch on the stream to rpcServer.ProcessRaft and
+// acks it before reading the next one. The stream's raftPriorityHeader (set
+// once by the client for the whole call) decides whether every batch on it
+// is queued to prioJobs or normalJobs, so a high-priority sender's batches
+// jump the queue ahead of a backlog of normal-priority ones from its peers.
+func (g *grpcServer) ProcessRaft(stream beehivepb.Transport_ProcessRaftServer) error {
+	prio := false
+	if md, ok := metadata.FromIncomingContext(stream.Context()); ok {
+		vals := md.Get(raftPriorityHeader)
+		prio = len(vals) > 0 && vals[0] == raftPriorityHigh
+	}
+
+	for {
+		pb, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		var batch raft.Batch
+		if err := gobDecode(pb.Payload, &batch); err != nil {
+			return err
+		}
+
+		done := make(chan error, 1)
+		job := raftJob{batch: batch, done: done}
+		if prio {
+			g.prioJobs <- job
+		} else {
+			g.normalJobs <- job
+		}
+		if err := <-done; err != nil {
+			return err
+		}
+
+		if err := stream.Send(&beehivepb.Empty{}); err != nil {
+			return err
+		}
+	}
+}
+
+func (g *grpcServer) ProcessCmd(ctx context.Context, pb *beehivepb.Cmd) (
+	*beehivepb.CmdResult, error) {
+
+	var cm cmd
+	if err := gobDecode(pb.Payload, &cm); err != nil {
+		return nil, err
+	}
+
+	var res []cmdResult
+	if err := g.s.ProcessCmd([]cmd{cm}, &res); err != nil {
+		return nil, err
+	}
+	return &beehivepb.CmdResult{Payload: gobEncode(res[0])}, nil
+}
+
+func (g *grpcServer) HiveState(ctx context.Context, _ *beehivepb.Empty) (
+	*beehivepb.HiveStateMsg, error) {
+
+	var state HiveState
+	if err := g.s.HiveState(struct{}{}, &state); err != nil {
+		return nil, err
+	}
+	return &beehivepb.HiveStateMsg{Payload: gobEncode(state)}, nil
+}
@@ -0,0 +1,245 @@
+package actor
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// raftRegistry is a Registry that needs no external coordinator: it
+// replicates actor placement through this module's own raft package, so a
+// single beehive cluster can run without etcd or Consul. It trades cross-
+// cluster sharing (registery for etcd, consulRegistry) for a dependency-free
+// single-cluster deployment. node is typically a *raft.Node; it is held as
+// the narrower raftProposer interface so tests can swap in a fake log.
+type raftRegistry struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	node   raftProposer
+	owner  map[string]regVal
+	locks  map[ActorName]ReceiverId
+	stages map[StageId]int64 // stage -> last heartbeat, unix seconds
+}
+
+// regCmd is the command type proposed through raft to mutate the
+// replicated owner map.
+type regCmd struct {
+	Lock   bool
+	Unlock bool
+	Key    string
+	Value  regVal
+	// Holder carries the requester's identity for Lock/Unlock; it is
+	// applied (not Key/Value) since the lock table is keyed by ActorName
+	// and the winner is whoever's Lock command applyRegCmd sees first.
+	Holder ReceiverId
+
+	// HeartbeatCmd marks Stage as seen at SeenAt; used by Heartbeat/Stages.
+	HeartbeatCmd bool
+	Stage        StageId
+	SeenAt       int64
+}
+
+// raftProposer is the subset of raft.Node that raftRegistry needs to
+// replicate a regCmd. raftRegistry depends on this interface rather than
+// *raft.Node directly so it can be exercised in tests against a fake
+// single-process log instead of a real raft cluster.
+type raftProposer interface {
+	Propose(v interface{}) error
+}
+
+// newRaftRegistry wraps an already-running raft.Node (or, in tests, a fake
+// raftProposer) as a Registry. The caller is responsible for starting the
+// node and wiring its apply channel into applyRegCmd.
+func newRaftRegistry(node raftProposer) *raftRegistry {
+	r := &raftRegistry{
+		node:   node,
+		owner:  make(map[string]regVal),
+		locks:  make(map[ActorName]ReceiverId),
+		stages: make(map[StageId]int64),
+	}
+	r.cond = sync.NewCond(&r.mu)
+	return r
+}
+
+// applyRegCmd applies a committed regCmd to the local replica of the owner
+// and lock maps. It is called from the raft apply loop (every replica of
+// raftRegistry applies the same sequence of committed commands), never
+// directly by Registry callers -- this is what actually makes Lock
+// cross-node: the lock table is only ever mutated here, not in Lock itself.
+func (r *raftRegistry) applyRegCmd(c regCmd) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	switch {
+	case c.Lock:
+		if _, held := r.locks[c.Holder.ActorName]; !held {
+			r.locks[c.Holder.ActorName] = c.Holder
+		}
+		r.cond.Broadcast()
+	case c.Unlock:
+		if held, ok := r.locks[c.Holder.ActorName]; ok && held == c.Holder {
+			delete(r.locks, c.Holder.ActorName)
+		}
+		r.cond.Broadcast()
+	case c.HeartbeatCmd:
+		r.stages[c.Stage] = c.SeenAt
+		r.cond.Broadcast()
+	default:
+		r.owner[c.Key] = c.Value
+		r.cond.Broadcast()
+	}
+}
+
+func (r *raftRegistry) key(actor ActorName, dk DictionaryKey) string {
+	return fmt.Sprintf(keyFmtStr, actor, dk.Dict, dk.Key)
+}
+
+// Lock implements Registry. It proposes a Lock command and waits for
+// applyRegCmd to actually grant it from the replicated log, rather than
+// assuming its own proposal won: if a concurrent proposer's Lock for the
+// same actor commits first, this loops around and waits on their Unlock
+// like any other contender would.
+func (r *raftRegistry) Lock(id ReceiverId) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for {
+		held, ok := r.locks[id.ActorName]
+		switch {
+		case ok && held == id:
+			return nil
+		case ok:
+			r.cond.Wait()
+		default:
+			if err := r.proposeLocked(regCmd{Lock: true, Holder: id}); err != nil {
+				return err
+			}
+			for {
+				if _, ok := r.locks[id.ActorName]; ok {
+					break
+				}
+				r.cond.Wait()
+			}
+		}
+	}
+}
+
+// Unlock implements Registry.
+func (r *raftRegistry) Unlock(id ReceiverId) error {
+	r.mu.Lock()
+	held, ok := r.locks[id.ActorName]
+	r.mu.Unlock()
+
+	if !ok || held != id {
+		return fmt.Errorf("raft-registry: unlocking someone else's lock: %v", id)
+	}
+
+	return r.propose(regCmd{Unlock: true, Holder: id})
+}
+
+// propose hands c to raft for replication.
+func (r *raftRegistry) propose(c regCmd) error {
+	if err := r.node.Propose(c); err != nil {
+		glog.Errorf("raft-registry: cannot propose %+v: %v", c, err)
+		return err
+	}
+	return nil
+}
+
+// proposeLocked is propose called while r.mu is already held, e.g. from
+// inside Lock.
+func (r *raftRegistry) proposeLocked(c regCmd) error {
+	r.mu.Unlock()
+	err := r.propose(c)
+	r.mu.Lock()
+	return err
+}
+
+// StoreOrGet implements Registry.
+func (r *raftRegistry) StoreOrGet(id ReceiverId, ms MapSet) regVal {
+	if err := r.Lock(id); err != nil {
+		glog.Errorf("raft-registry: cannot lock %v: %v", id.ActorName, err)
+		return regVal{StageId: id.StageId, RcvrId: id.RcvrId}
+	}
+	defer r.Unlock(id)
+
+	v := regVal{StageId: id.StageId, RcvrId: id.RcvrId}
+
+	r.mu.Lock()
+	for _, dk := range ms {
+		if resV, ok := r.owner[r.key(id.ActorName, dk)]; ok && !resV.Eq(&v) {
+			r.mu.Unlock()
+			return resV
+		}
+	}
+	r.mu.Unlock()
+
+	for _, dk := range ms {
+		if err := r.propose(regCmd{Key: r.key(id.ActorName, dk), Value: v}); err != nil {
+			break
+		}
+	}
+
+	return v
+}
+
+// Set implements Registry.
+func (r *raftRegistry) Set(id ReceiverId, ms MapSet) regVal {
+	v := regVal{StageId: id.StageId, RcvrId: id.RcvrId}
+	for _, dk := range ms {
+		if err := r.propose(regCmd{Key: r.key(id.ActorName, dk), Value: v}); err != nil {
+			break
+		}
+	}
+	return v
+}
+
+// Get implements Registry.
+func (r *raftRegistry) Get(actor ActorName, dk DictionaryKey) (regVal, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	v, ok := r.owner[r.key(actor, dk)]
+	if !ok {
+		return regVal{}, fmt.Errorf("raft-registry: no owner for %v/%v", actor, dk)
+	}
+	return v, nil
+}
+
+// Watch implements Registry. Since the owner map is only ever mutated by
+// applyRegCmd under r.mu, Watch just waits on the same condition variable
+// used for lock hand-off.
+func (r *raftRegistry) Watch(actor ActorName, dk DictionaryKey) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	before, existed := r.owner[r.key(actor, dk)]
+	for {
+		after, ok := r.owner[r.key(actor, dk)]
+		if ok != existed || (ok && !after.Eq(&before)) {
+			return nil
+		}
+		r.cond.Wait()
+	}
+}
+
+// Heartbeat implements Registry.
+func (r *raftRegistry) Heartbeat(id StageId) error {
+	return r.propose(regCmd{HeartbeatCmd: true, Stage: id, SeenAt: time.Now().Unix()})
+}
+
+// Stages implements Registry. raftRegistry keeps no TTL: every stage that
+// has ever heartbeated is returned, and a stage that stops heartbeating is
+// never aged out.
+func (r *raftRegistry) Stages() ([]StageId, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stages := make([]StageId, 0, len(r.stages))
+	for id := range r.stages {
+		stages = append(stages, id)
+	}
+	return stages, nil
+}
@@ -0,0 +1,96 @@
+package actor
+
+import (
+	"testing"
+	"time"
+)
+
+// fakeRaftLog is a minimal stand-in for a raft.Node shared by two
+// raftRegistry instances: every Propose is applied, in proposal order, to
+// every registry attached to the log. It is enough to exercise
+// applyRegCmd's replicated lock hand-off without a real raft cluster.
+type fakeRaftLog struct {
+	registries []*raftRegistry
+}
+
+type fakeProposer struct {
+	log *fakeRaftLog
+}
+
+func (p *fakeProposer) Propose(v interface{}) error {
+	c := v.(regCmd)
+	for _, r := range p.log.registries {
+		r.applyRegCmd(c)
+	}
+	return nil
+}
+
+func TestRaftRegistryLockIsCrossNode(t *testing.T) {
+	log := &fakeRaftLog{}
+	proposer := &fakeProposer{log: log}
+
+	a := newRaftRegistry(proposer)
+	b := newRaftRegistry(proposer)
+	log.registries = []*raftRegistry{a, b}
+
+	id1 := ReceiverId{ActorName: "actor", RcvrId: 1}
+	id2 := ReceiverId{ActorName: "actor", RcvrId: 2}
+
+	if err := a.Lock(id1); err != nil {
+		t.Fatalf("a.Lock(id1): %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- b.Lock(id2) }()
+
+	select {
+	case err := <-done:
+		t.Fatalf("b.Lock(id2) should have blocked while a (a different "+
+			"raftRegistry instance) holds the lock, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if err := a.Unlock(id1); err != nil {
+		t.Fatalf("a.Unlock(id1): %v", err)
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("b.Lock(id2) after a.Unlock(id1): %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("b.Lock(id2) never unblocked after a.Unlock(id1)")
+	}
+}
+
+func TestRaftRegistryWatchWakesOnSet(t *testing.T) {
+	log := &fakeRaftLog{}
+	proposer := &fakeProposer{log: log}
+
+	r := newRaftRegistry(proposer)
+	log.registries = []*raftRegistry{r}
+
+	actor := ActorName("actor")
+	dk := DictionaryKey{Dict: "d", Key: "k"}
+
+	done := make(chan error, 1)
+	go func() { done <- r.Watch(actor, dk) }()
+
+	select {
+	case err := <-done:
+		t.Fatalf("Watch returned before any Set, err=%v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	r.Set(ReceiverId{ActorName: actor, RcvrId: 1}, MapSet{dk})
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Watch: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Watch never woke up after Set applied a new owner")
+	}
+}
@@ -11,6 +11,35 @@ import (
 	"github.com/golang/glog"
 )
 
+// Registry is the coordination backend used to place MapSets on stages: it
+// arbitrates locks on actors, records (or looks up) which stage owns a
+// MapSet, and notifies callers when an owning key changes. registery (etcd),
+// consulRegistry and raftRegistry are the three backends shipped with
+// this package; a deployment picks one via HiveConfig so operators can
+// choose a coordinator without recompiling.
+type Registry interface {
+	// Lock blocks until this receiver holds the lock for its actor.
+	Lock(id ReceiverId) error
+	// Unlock releases a lock previously acquired with Lock. It is an error
+	// to unlock a lock held by another receiver.
+	Unlock(id ReceiverId) error
+	// StoreOrGet stores id as the owner of every key in ms if none of them
+	// is already owned, otherwise it returns the existing owner.
+	StoreOrGet(id ReceiverId, ms MapSet) regVal
+	// Set unconditionally stores id as the owner of every key in ms.
+	Set(id ReceiverId, ms MapSet) regVal
+	// Get returns the current owner of a single dictionary key.
+	Get(actor ActorName, dk DictionaryKey) (regVal, error)
+	// Watch blocks until the owner of dk changes.
+	Watch(actor ActorName, dk DictionaryKey) error
+	// Heartbeat marks id as a live stage for roughly one registry TTL. A
+	// stage that wants to participate in rendezvous placement (see
+	// mapper.pollLiveStages) must call this periodically.
+	Heartbeat(id StageId) error
+	// Stages returns the set of stage IDs that have heartbeated recently.
+	Stages() ([]StageId, error)
+}
+
 type registery struct {
 	*etcd.Client
 	prefix string
@@ -61,13 +90,15 @@ const (
 	keyFmtStr    = "/theatre/%s/%s/%s"
 	expireAction = "expire"
 	lockFileName = "__lock__"
+	stagesDir    = "__stages__"
 )
 
 func (g registery) path(elem ...string) string {
 	return g.prefix + "/" + strings.Join(elem, "/")
 }
 
-func (g registery) lockActor(id ReceiverId) error {
+// Lock implements Registry.
+func (g registery) Lock(id ReceiverId) error {
 	// TODO(soheil): For lock and unlock we can use etcd indices but
 	// v.Temp might be changed by the app. Check this and fix it if possible.
 	v := regVal{
@@ -82,21 +113,22 @@ func (g registery) lockActor(id ReceiverId) error {
 			return nil
 		}
 
-		_, err = g.Watch(k, 0, false, nil, nil)
+		_, err = g.Client.Watch(k, 0, false, nil, nil)
 		if err != nil {
 			return err
 		}
 	}
 }
 
-func (g registery) unlockActor(id ReceiverId) error {
+// Unlock implements Registry.
+func (g registery) Unlock(id ReceiverId) error {
 	v := regVal{
 		StageId: id.StageId,
 		RcvrId:  id.RcvrId,
 	}
 	k := g.path(string(id.ActorName), lockFileName)
 
-	res, err := g.Get(k, false, false)
+	res, err := g.etcdGet(k)
 	if err != nil {
 		return err
 	}
@@ -115,9 +147,10 @@ func (g registery) unlockActor(id ReceiverId) error {
 	return nil
 }
 
-func (g registery) storeOrGet(id ReceiverId, ms MapSet) regVal {
-	g.lockActor(id)
-	defer g.unlockActor(id)
+// StoreOrGet implements Registry.
+func (g registery) StoreOrGet(id ReceiverId, ms MapSet) regVal {
+	g.Lock(id)
+	defer g.Unlock(id)
 
 	sort.Sort(ms)
 
@@ -129,8 +162,7 @@ func (g registery) storeOrGet(id ReceiverId, ms MapSet) regVal {
 	validate := false
 	for _, dk := range ms {
 		k := fmt.Sprintf(keyFmtStr, id.ActorName, dk.Dict, dk.Key)
-		fmt.Println(k)
-		res, err := g.Get(k, false, false)
+		res, err := g.etcdGet(k)
 		if err != nil {
 			continue
 		}
@@ -155,4 +187,92 @@ func (g registery) storeOrGet(id ReceiverId, ms MapSet) regVal {
 	}
 
 	return v
-}
\ No newline at end of file
+}
+
+// Set implements Registry. Unlike StoreOrGet it never defers to an existing
+// owner: it is used by callers (e.g. mapper.migrate) that have already
+// established ownership out of band and just need the registry updated.
+func (g registery) Set(id ReceiverId, ms MapSet) regVal {
+	g.Lock(id)
+	defer g.Unlock(id)
+
+	sort.Sort(ms)
+
+	v := regVal{
+		StageId: id.StageId,
+		RcvrId:  id.RcvrId,
+	}
+	mv := marshallRegValOrFail(v)
+	for _, dk := range ms {
+		k := fmt.Sprintf(keyFmtStr, id.ActorName, dk.Dict, dk.Key)
+		g.Delete(k, false)
+		g.Create(k, mv, g.ttl)
+	}
+
+	return v
+}
+
+// Get implements Registry.
+func (g registery) Get(actor ActorName, dk DictionaryKey) (regVal, error) {
+	k := fmt.Sprintf(keyFmtStr, actor, dk.Dict, dk.Key)
+	res, err := g.etcdGet(k)
+	if err != nil {
+		return regVal{}, err
+	}
+	return unmarshallRegValOrFail(res.Node.Value), nil
+}
+
+// Watch implements Registry.
+func (g registery) Watch(actor ActorName, dk DictionaryKey) error {
+	k := fmt.Sprintf(keyFmtStr, actor, dk.Dict, dk.Key)
+	_, err := g.Client.Watch(k, 0, false, nil, nil)
+	return err
+}
+
+func (g registery) etcdGet(k string) (*etcd.Response, error) {
+	return g.Client.Get(k, false, false)
+}
+
+func (g registery) stageKey(id StageId) string {
+	return g.path(stagesDir, fmt.Sprintf("%v", id))
+}
+
+// Heartbeat implements Registry.
+func (g registery) Heartbeat(id StageId) error {
+	v, err := json.Marshal(id)
+	if err != nil {
+		return err
+	}
+
+	_, err = g.Client.Set(g.stageKey(id), string(v), g.ttl)
+	return err
+}
+
+// Stages implements Registry by listing the stages directory every
+// Heartbeat writes into; an entry ages out on its own once its TTL lapses
+// without a fresh heartbeat, the same way a lock does.
+func (g registery) Stages() ([]StageId, error) {
+	res, err := g.Client.Get(g.path(stagesDir), false, true)
+	if err != nil {
+		if eerr, ok := err.(*etcd.EtcdError); ok && eerr.ErrorCode == etcd.ErrCodeKeyNotFound {
+			// No stage has heartbeated yet, so the directory itself hasn't
+			// been created: that's zero live stages, not a failed refresh.
+			return nil, nil
+		}
+		// Any other error (timeout, connection refused, ...) is a failed
+		// refresh, not an empty stage set: surface it so pollLiveStages
+		// keeps its last-known liveStages instead of clearing it on a
+		// transient etcd hiccup.
+		return nil, err
+	}
+
+	stages := make([]StageId, 0, len(res.Node.Nodes))
+	for _, n := range res.Node.Nodes {
+		var id StageId
+		if err := json.Unmarshal([]byte(n.Value), &id); err != nil {
+			continue
+		}
+		stages = append(stages, id)
+	}
+	return stages, nil
+}
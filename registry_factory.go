@@ -0,0 +1,78 @@
+package actor
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/coreos/go-etcd/etcd"
+)
+
+// RegistryBackend names one of the Registry implementations NewRegistry can
+// construct. HiveConfig exposes this as a string so an operator picks a
+// coordinator per deployment instead of recompiling.
+type RegistryBackend string
+
+const (
+	// RegistryEtcd is the default: an etcd.Client-backed registery, for a
+	// cluster of hives sharing an external etcd.
+	RegistryEtcd RegistryBackend = "etcd"
+	// RegistryConsul is the Consul KV/session-backed equivalent of
+	// RegistryEtcd, for deployments that already run Consul instead.
+	RegistryConsul RegistryBackend = "consul"
+	// RegistryRaft needs no external coordinator: it replicates through
+	// this module's own raft package, for a single-cluster deployment that
+	// doesn't want to stand up etcd or Consul.
+	RegistryRaft RegistryBackend = "raft"
+)
+
+// RegistryConfig selects and configures the Registry backend NewRegistry
+// constructs. Addrs is the etcd machine list or the single Consul agent
+// address, depending on Backend; it is ignored for RegistryRaft, which uses
+// Node instead.
+type RegistryConfig struct {
+	Backend RegistryBackend
+	Addrs   []string
+	Prefix  string
+	TTL     uint64
+
+	// Node is the already-started raft.Node (or, in tests, a fake
+	// raftProposer) backing RegistryRaft. Required only for that backend.
+	Node raftProposer
+}
+
+// NewRegistry constructs the Registry cfg.Backend names. An empty Backend
+// defaults to RegistryEtcd, matching registery's behavior from before
+// Registry became pluggable.
+func NewRegistry(cfg RegistryConfig) (Registry, error) {
+	switch cfg.Backend {
+	case "", RegistryEtcd:
+		return newEtcdRegistry(cfg.Addrs, cfg.Prefix, cfg.TTL), nil
+
+	case RegistryConsul:
+		addr := ""
+		if len(cfg.Addrs) > 0 {
+			addr = cfg.Addrs[0]
+		}
+		return newConsulRegistry(addr, cfg.Prefix, fmt.Sprintf("%ds", cfg.TTL))
+
+	case RegistryRaft:
+		if cfg.Node == nil {
+			return nil, errors.New("registry: raft backend requires a Node")
+		}
+		return newRaftRegistry(cfg.Node), nil
+
+	default:
+		return nil, fmt.Errorf("registry: unknown backend %q", cfg.Backend)
+	}
+}
+
+// newEtcdRegistry dials the etcd machines and returns a Registry that
+// stores actor placement under prefix, the constructor registery itself was
+// missing before Registry had other backends to pick from.
+func newEtcdRegistry(machines []string, prefix string, ttl uint64) *registery {
+	return &registery{
+		Client: etcd.NewClient(machines),
+		prefix: prefix,
+		ttl:    ttl,
+	}
+}
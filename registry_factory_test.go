@@ -0,0 +1,29 @@
+package actor
+
+import "testing"
+
+func TestNewRegistryRaftRequiresNode(t *testing.T) {
+	_, err := NewRegistry(RegistryConfig{Backend: RegistryRaft})
+	if err == nil {
+		t.Fatal("NewRegistry with RegistryRaft and no Node should error")
+	}
+}
+
+func TestNewRegistryRaft(t *testing.T) {
+	log := &fakeRaftLog{}
+	proposer := &fakeProposer{log: log}
+
+	r, err := NewRegistry(RegistryConfig{Backend: RegistryRaft, Node: proposer})
+	if err != nil {
+		t.Fatalf("NewRegistry: %v", err)
+	}
+	if _, ok := r.(*raftRegistry); !ok {
+		t.Fatalf("NewRegistry(RegistryRaft) = %T, want *raftRegistry", r)
+	}
+}
+
+func TestNewRegistryUnknownBackend(t *testing.T) {
+	if _, err := NewRegistry(RegistryConfig{Backend: "bogus"}); err == nil {
+		t.Fatal("NewRegistry with an unknown backend should error")
+	}
+}
@@ -12,6 +12,8 @@ import (
 	"github.com/kandoo/beehive/Godeps/_workspace/src/golang.org/x/net/context"
 	bhgob "github.com/kandoo/beehive/gob"
 	"github.com/kandoo/beehive/raft"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 const (
@@ -58,23 +60,83 @@ func (cb clientBackoff) isSet() bool {
 	return cb == clientBackoff{}
 }
 
+// transport is the wire protocol rpcClientPool speaks to reach another
+// hive. rpcClient (net/rpc, the long-standing default) and grpcClient (see
+// grpc.go) both implement it, so sendRaft/sendMsg/sendCmd and the pool's
+// caching/backoff logic don't need to know which one they have.
+type transport interface {
+	sendRaft(batch *raft.Batch, r raft.Reporter) error
+	sendMsg(msgs []msg) error
+	sendCmd(cm cmd) (res interface{}, err error)
+	hiveState() (state HiveState, err error)
+	stop()
+}
+
+// dialTransport dials addr using the transport named by kind (TransportGRPC
+// or TransportGobRPC; anything else falls back to TransportGobRPC so an
+// empty/unset HiveConfig.Transport keeps today's behavior).
+func dialTransport(kind, addr string) (transport, error) {
+	if kind == TransportGRPC {
+		return newGRPCClient(addr)
+	}
+	return newRPCClient(addr)
+}
+
+// defaultCacheSize and defaultCacheTTL bound the local tier of
+// rpcClientPool's bee/hive lookup caches (see bee_cache.go) when
+// HiveConfig doesn't override them.
+const (
+	defaultCacheSize = 64 * 1024
+	defaultCacheTTL  = time.Minute
+
+	// beeCacheWatchInterval is how often watchBeeCache re-resolves every
+	// cached bee to look for a moved or deleted owner.
+	beeCacheWatchInterval = 5 * time.Second
+)
+
 type rpcClientPool struct {
 	sync.RWMutex
 	hive *hive
 
-	hiveClients map[uint64]*rpcClient
-	beeClients  map[uint64]*rpcClient
+	hiveClients map[uint64]transport
+	beeClients  map[uint64]transport
 
 	retries map[uint64]*dialTry
+
+	// beeCache and hiveCache are the two-tier (local LRU + optional
+	// shared backend) caches in front of p.hive.bee and
+	// p.hive.registry.hive respectively, so a busy bee's owning hive
+	// doesn't cost a registry round trip on every send.
+	//
+	// p.hive.registry resolves hive addresses through hive.go's own
+	// lookup, not through actor.Registry (see actor.NewRegistry and its
+	// RegistryBackend switch): hive.go, where that field and HiveConfig
+	// are declared, is outside this package's tree. Pointing
+	// p.hive.registry.hive at an actor.Registry instance so an operator's
+	// RegistryBackend choice also governs hive address resolution belongs
+	// there, alongside whatever constructs *hive today.
+	beeCache  *beeLookupCache
+	hiveCache *hiveLookupCache
 }
 
 func newRPCClientPool(h *hive) *rpcClientPool {
-	return &rpcClientPool{
+	var shared sharedCache
+	if h.config.BeeCacheRedisAddr != "" {
+		shared = newRedisSharedCache(h.config.BeeCacheRedisAddr, defaultCacheTTL)
+	}
+
+	p := &rpcClientPool{
 		hive:        h,
-		hiveClients: make(map[uint64]*rpcClient),
-		beeClients:  make(map[uint64]*rpcClient),
+		hiveClients: make(map[uint64]transport),
+		beeClients:  make(map[uint64]transport),
 		retries:     make(map[uint64]*dialTry),
+		beeCache:    newBeeLookupCache(defaultCacheSize, defaultCacheTTL, shared),
+		hiveCache:   newHiveLookupCache(defaultCacheSize, defaultCacheTTL, nil),
 	}
+
+	go p.watchBeeCache()
+
+	return p
 }
 
 func (p *rpcClientPool) stop() {
@@ -95,8 +157,21 @@ func (p *rpcClientPool) shouldReset(err error) bool {
 		return true
 	}
 
-	nerr, ok := err.(net.Error)
-	return ok && !nerr.Temporary()
+	if nerr, ok := err.(net.Error); ok {
+		return !nerr.Temporary()
+	}
+
+	// grpcClient returns gRPC status errors, which implement neither
+	// rpc.ErrShutdown nor net.Error, so without this a dead grpcClient
+	// connection would never get evicted via resetHiveClient. These codes
+	// all mean the connection itself is unusable, not just this one call.
+	switch status.Code(err) {
+	case codes.Unavailable, codes.Canceled, codes.DeadlineExceeded,
+		codes.Aborted, codes.Internal:
+		return true
+	}
+
+	return false
 }
 
 func (p *rpcClientPool) sendRaft(batch *raft.Batch, r raft.Reporter) error {
@@ -150,14 +225,14 @@ func (p *rpcClientPool) sendCmd(cmd cmd) (res interface{}, err error) {
 	return
 }
 
-func (p *rpcClientPool) lookupHive(hive uint64) (client *rpcClient, ok bool) {
+func (p *rpcClientPool) lookupHive(hive uint64) (client transport, ok bool) {
 	p.RLock()
 	client, ok = p.hiveClients[hive]
 	p.RUnlock()
 	return
 }
 
-func (p *rpcClientPool) setHive(hive uint64, client *rpcClient) {
+func (p *rpcClientPool) setHive(hive uint64, client transport) {
 	p.Lock()
 	p.hiveClients[hive] = client
 	p.Unlock()
@@ -186,7 +261,7 @@ func (p *rpcClientPool) setRetry(hive uint64, t *dialTry) {
 	p.Unlock()
 }
 
-func (p *rpcClientPool) hiveClient(hive uint64) (client *rpcClient, err error) {
+func (p *rpcClientPool) hiveClient(hive uint64) (client transport, err error) {
 	c, ok := p.lookupHive(hive)
 	if ok {
 		return c, nil
@@ -195,14 +270,20 @@ func (p *rpcClientPool) hiveClient(hive uint64) (client *rpcClient, err error) {
 	return p.resetHiveClient(hive, nil)
 }
 
-func (p *rpcClientPool) resetHiveClient(hive uint64, prev *rpcClient) (
-	client *rpcClient, err error) {
+func (p *rpcClientPool) resetHiveClient(hive uint64, prev transport) (
+	client transport, err error) {
 
 	client, ok := p.lookupHive(hive)
 	if ok && client != prev {
 		return
 	}
 
+	// The capabilities cached on prev (see rpcClient.caps) were negotiated
+	// with whatever process was listening on the old connection; they must
+	// not survive into the replacement client, which renegotiates its own
+	// on its first dial.
+	invalidateCaps(prev)
+
 	p.deleteHive(hive)
 	if client, err = p.newClient(hive); err != nil {
 		return
@@ -212,7 +293,16 @@ func (p *rpcClientPool) resetHiveClient(hive uint64, prev *rpcClient) (
 	return
 }
 
-func (p *rpcClientPool) newClient(hive uint64) (client *rpcClient, err error) {
+// invalidateCaps clears the capability cache on c if c is an *rpcClient.
+// It is a no-op for other transport implementations, which don't cache
+// capabilities the same way.
+func invalidateCaps(c transport) {
+	if rc, ok := c.(*rpcClient); ok {
+		rc.invalidateCaps()
+	}
+}
+
+func (p *rpcClientPool) newClient(hive uint64) (client transport, err error) {
 	t := p.lookupRetry(hive)
 
 	t.Lock()
@@ -229,12 +319,15 @@ func (p *rpcClientPool) newClient(hive uint64) (client *rpcClient, err error) {
 		return nil, &rpcBackoffError{Until: t.next}
 	}
 
-	i, err := p.hive.registry.hive(hive)
-	if err != nil {
-		return nil, err
+	i, ok := p.hiveCache.getHive(hive)
+	if !ok {
+		if i, err = p.hive.registry.hive(hive); err != nil {
+			return nil, err
+		}
+		p.hiveCache.setHive(hive, i)
 	}
 
-	if client, err = newRPCClient(i.Addr); err != nil {
+	if client, err = dialTransport(p.hive.config.Transport, i.Addr); err != nil {
 		// contention here.
 		t.tries++
 		t.wait *= 2
@@ -253,26 +346,103 @@ func (p *rpcClientPool) newClient(hive uint64) (client *rpcClient, err error) {
 	return client, nil
 }
 
-func (p *rpcClientPool) beeClient(bee uint64) (client *rpcClient, err error) {
-	i, err := p.hive.bee(bee)
-	if err != nil {
-		return
+func (p *rpcClientPool) beeClient(bee uint64) (client transport, err error) {
+	i, ok := p.beeCache.getBee(bee)
+	if !ok {
+		if i, err = p.hive.bee(bee); err != nil {
+			return
+		}
+		p.beeCache.setBee(bee, i)
 	}
 
 	return p.hiveClient(i.Hive)
 }
 
-func (p *rpcClientPool) resetBeeClient(bee uint64, prevClient *rpcClient) (
-	client *rpcClient, err error) {
+// resetBeeClient evicts bee from both cache tiers before re-resolving it,
+// in case the stale entry (rather than the hive connection itself) is why
+// the caller is resetting.
+func (p *rpcClientPool) resetBeeClient(bee uint64, prevClient transport) (
+	client transport, err error) {
+
+	p.beeCache.delBee(bee)
 
 	i, err := p.hive.bee(bee)
 	if err != nil {
 		return
 	}
+	p.beeCache.setBee(bee, i)
 
 	return p.resetHiveClient(i.Hive, prevClient)
 }
 
+// onBeeMoved evicts bee from the lookup cache. It is called from
+// watchBeeCache when a cached bee's owner no longer matches the registry,
+// so the cache doesn't go on serving a stale owner until its TTL expires.
+func (p *rpcClientPool) onBeeMoved(bee uint64) {
+	p.beeCache.delBee(bee)
+}
+
+// watchBeeCache drives onBeeMoved: it periodically re-resolves every
+// currently cached bee against the registry and evicts any whose owner has
+// changed, instead of waiting out the TTL. This is the closest
+// approximation to a registry watch available at this layer -- if
+// p.hive.registry ever exposes a real bee-moved event stream, this loop
+// should subscribe to that instead of polling. It also logs the local/
+// shared hit-miss counters bee_cache.go tracks, which otherwise nothing
+// reads.
+func (p *rpcClientPool) watchBeeCache() {
+	ticker := time.NewTicker(beeCacheWatchInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		for _, bee := range p.beeCache.knownBees() {
+			cached, ok := p.beeCache.getBee(bee)
+			if !ok {
+				continue
+			}
+
+			cur, err := p.hive.bee(bee)
+			if err != nil || cur.Hive != cached.Hive {
+				p.onBeeMoved(bee)
+			}
+		}
+
+		lh, lm, sh, sm := p.beeCache.counts()
+		glog.V(2).Infof("bee cache: local %d hit/%d miss, shared %d hit/%d miss",
+			lh, lm, sh, sm)
+	}
+}
+
+// Capabilities rpcClientPool/rpcServer may negotiate. A capability only
+// changes how a client uses the wire once both ends report it, so a
+// cluster can roll a new one out hive by hive without a flag day.
+const (
+	capRaftBatchV2      = "raft-batch-v2"
+	capMsgStream        = "msg-stream"
+	capSnapshotCompress = "snapshot-compress"
+	capPrioChannel      = "prio-channel"
+)
+
+// rpcProtoVersion is reported by rpcServer.Capabilities and stored (but not
+// currently gated on) by the client, mirroring how etcd's peer API reports
+// a version alongside its capability map.
+const rpcProtoVersion = "1"
+
+// serverCaps is what this binary's rpcServer supports; newRPCClient
+// intersects it with whatever the peer reports.
+var serverCaps = map[string]bool{
+	capRaftBatchV2:      true,
+	capMsgStream:        true,
+	capSnapshotCompress: true,
+	capPrioChannel:      true,
+}
+
+// capsReply is the result of rpcServer.Capabilities.
+type capsReply struct {
+	Version string
+	Caps    map[string]bool
+}
+
 type rpcClient struct {
 	addr string
 
@@ -280,6 +450,10 @@ type rpcClient struct {
 	msg  *rpc.Client
 	raft *rpc.Client
 	prio *rpc.Client
+
+	capsMu  sync.RWMutex
+	version string
+	caps    map[string]bool
 }
 
 func (c rpcClient) String() string {
@@ -318,9 +492,53 @@ func newRPCClient(addr string) (client *rpcClient, err error) {
 		client.msg = rpc.NewClient(msgConn)
 	}
 
+	client.negotiateCaps()
+
 	return client, nil
 }
 
+// negotiateCaps calls rpcServer.Capabilities on the freshly dialed cmd
+// connection and stores the intersection with serverCaps. A failure (e.g.
+// an older peer that doesn't have the Capabilities method yet) just leaves
+// caps empty, so sendRaft/sendMsg/sendCmd fall back to the baseline wire
+// forms.
+func (c *rpcClient) negotiateCaps() {
+	var reply capsReply
+	if err := c.cmd.Call("rpcServer.Capabilities", struct{}{}, &reply); err != nil {
+		glog.V(2).Infof("%v cannot negotiate capabilities, assuming none: %v", c, err)
+		return
+	}
+
+	shared := make(map[string]bool, len(reply.Caps))
+	for cp := range reply.Caps {
+		if serverCaps[cp] {
+			shared[cp] = true
+		}
+	}
+
+	c.capsMu.Lock()
+	c.version = reply.Version
+	c.caps = shared
+	c.capsMu.Unlock()
+}
+
+// has reports whether cp was in the capability intersection negotiated at
+// dial time.
+func (c *rpcClient) has(cp string) bool {
+	c.capsMu.RLock()
+	defer c.capsMu.RUnlock()
+	return c.caps[cp]
+}
+
+// invalidateCaps clears the negotiated capability cache, so the entry in
+// rpcClientPool.hiveClients/beeClients that still points at this client
+// (however briefly, during a reset) doesn't act on a stale capability set.
+func (c *rpcClient) invalidateCaps() {
+	c.capsMu.Lock()
+	c.caps = nil
+	c.capsMu.Unlock()
+}
+
 func (c *rpcClient) sendMsg(msgs []msg) error {
 	var f struct{}
 	glog.V(3).Infof("%v sends %v messages", c, len(msgs))
@@ -366,11 +584,19 @@ func report(err error, batch *raft.Batch, r raft.Reporter) {
 
 func (c *rpcClient) sendRaft(batch *raft.Batch, r raft.Reporter) (err error) {
 	glog.V(3).Infof("%v sends a raft batch", c)
+
+	method := "rpcServer.ProcessRaft"
+	var arg interface{} = batch
+	if c.has(capRaftBatchV2) {
+		method = "rpcServer.ProcessRaftV2"
+		arg = &raftBatchV2{Batch: *batch}
+	}
+
 	var dummy bool
 	if batch.Priority == raft.High {
-		err = c.prio.Call("rpcServer.ProcessRaft", batch, &dummy)
+		err = c.prio.Call(method, arg, &dummy)
 	} else {
-		err = c.raft.Call("rpcServer.ProcessRaft", batch, &dummy)
+		err = c.raft.Call(method, arg, &dummy)
 	}
 	report(err, batch, r)
 	return err
@@ -407,6 +633,18 @@ func newRPCServer(h *hive) *rpcServer {
 	}
 }
 
+// Capabilities reports this hive's protocol version and the wire-format
+// capabilities its rpcServer understands, so a dialing rpcClient can learn
+// which newer forms (see the cap* constants) it's safe to use without a
+// cluster-wide flag day.
+func (s *rpcServer) Capabilities(dummy struct{}, reply *capsReply) error {
+	*reply = capsReply{
+		Version: rpcProtoVersion,
+		Caps:    serverCaps,
+	}
+	return nil
+}
+
 func (s *rpcServer) HiveState(dummy struct{}, state *HiveState) error {
 	*state = HiveState{
 		ID:    s.h.ID(),
@@ -502,6 +740,19 @@ func (s *rpcServer) ProcessRaft(batch raft.Batch, dummy *bool) (err error) {
 	return
 }
 
+// raftBatchV2 is the capRaftBatchV2 wire form of a raft batch. It wraps the
+// same raft.Batch the baseline ProcessRaft takes; the v2 name exists so
+// ProcessRaft's untyped signature can change in the future (e.g. carrying
+// per-batch compression or trace metadata) behind the same capability gate
+// rpcClient already checks before choosing this method.
+type raftBatchV2 struct {
+	Batch raft.Batch
+}
+
+func (s *rpcServer) ProcessRaftV2(v raftBatchV2, dummy *bool) error {
+	return s.ProcessRaft(v.Batch, dummy)
+}
+
 func (s *rpcServer) EnqueMsg(msgs []msg, dummy *struct{}) error {
 	for i := range msgs {
 		s.h.enqueMsg(&msgs[i])